@@ -0,0 +1,108 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+// audit records an administrative action taken by the user making the request.
+// The action has already happened by the time we get here, so failing to write
+// the entry is logged rather than reported to the client.
+func (app *application) audit(r *http.Request, action, targetType string, targetID int, before, after interface{}) {
+	changes, err := data.AuditDiff(before, after)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "cannot diff audit log entry", "error", err)
+	}
+
+	entry := data.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Changes:    changes,
+		IPAddress:  clientIP(r),
+	}
+
+	if actor := app.contextGetUser(r); actor != nil {
+		entry.ActorID = actor.ID
+		entry.ActorEmail = actor.Email
+	}
+
+	if err := app.models.AuditLog.Insert(r.Context(), entry); err != nil {
+		app.logger.ErrorContext(r.Context(), "cannot write audit log entry", "action", action, "error", err)
+	}
+}
+
+// AuditLogs returns one page of the audit log. It can be filtered with the actor_id, action,
+// target_type, target_id, from and to (RFC 3339) query parameters, and paged with page and page_size.
+func (app *application) AuditLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := data.AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		Page:       1,
+		PageSize:   defaultAuditPageSize,
+	}
+
+	var err error
+
+	intParams := map[string]*int{
+		"actor_id":  &filter.ActorID,
+		"target_id": &filter.TargetID,
+		"page":      &filter.Page,
+		"page_size": &filter.PageSize,
+	}
+	for name, dest := range intParams {
+		if v := query.Get(name); v != "" {
+			if *dest, err = strconv.Atoi(v); err != nil {
+				app.errorJSON(w, r, errors.New("invalid "+name))
+				return
+			}
+		}
+	}
+
+	timeParams := map[string]*time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	}
+	for name, dest := range timeParams {
+		if v := query.Get(name); v != "" {
+			if *dest, err = time.Parse(time.RFC3339, v); err != nil {
+				app.errorJSON(w, r, errors.New("invalid "+name+", expected an RFC 3339 timestamp"))
+				return
+			}
+		}
+	}
+
+	if filter.Page < 1 || filter.PageSize < 1 || filter.PageSize > maxAuditPageSize {
+		app.errorJSON(w, r, errors.New("page must be at least 1, and page_size between 1 and "+strconv.Itoa(maxAuditPageSize)))
+		return
+	}
+
+	entries, total, err := app.models.AuditLog.GetAll(r.Context(), filter)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data: envelope{
+			"entries":   entries,
+			"total":     total,
+			"page":      filter.Page,
+			"page_size": filter.PageSize,
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var bookColumns = []string{"id", "title", "author_id", "publication_year", "slug", "description", "created_at", "updated_at", "version", "cover_hash",
+	"id", "author_name", "created_at", "updated_at"}
+
+func TestApplication_AuditLogs(t *testing.T) {
+	mock := newMockDB(t)
+
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"id", "actor_id", "actor_email", "action", "target_type", "target_id", "changes", "ip_address", "created_at", "total"}).
+		AddRow(1, 2, "admin@example.com", "book.delete", "book", 5, []byte(`{"title":{"before":"It","after":null}}`), "127.0.0.1", time.Now(), 11)
+
+	mock.ExpectQuery("from audit_logs where target_type = \\$1 and created_at >= \\$2 order by created_at desc, id desc limit \\$3 offset \\$4").
+		WithArgs("book", from, 10, 10).
+		WillReturnRows(rows)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/audit?target_type=book&from=2022-01-01T00:00:00Z&page=2&page_size=10", nil)
+	http.HandlerFunc(testApp.AuditLogs).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatal("AuditLogs returned wrong status code of", rr.Code, rr.Body.String())
+	}
+
+	var payload struct {
+		Data struct {
+			Entries []data.AuditLog `json:"entries"`
+			Total   int             `json:"total"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+	if payload.Data.Total != 11 || len(payload.Data.Entries) != 1 {
+		t.Fatalf("unexpected page %+v", payload.Data)
+	}
+
+	if payload.Data.Entries[0].Changes["title"].Before != "It" {
+		t.Errorf("changes not decoded, got %+v", payload.Data.Entries[0].Changes)
+	}
+}
+
+func TestApplication_AuditLogs_BadFilter(t *testing.T) {
+	var tests = []string{
+		"?page=0",
+		"?page_size=1000",
+		"?actor_id=me",
+		"?from=yesterday",
+	}
+
+	for _, query := range tests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/audit"+query, nil)
+		http.HandlerFunc(testApp.AuditLogs).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 but got %d", query, rr.Code)
+		}
+	}
+}
+
+func TestApplication_DeleteBook_Audited(t *testing.T) {
+	mock := newMockDB(t)
+
+	mock.ExpectQuery("where b.id = \\$1").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(bookColumns).AddRow(5, "It", 1, 1986, "it", "", time.Now(), time.Now(), 3, "", 1, "Stephen King", time.Now(), time.Now()))
+	mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+	mock.ExpectExec("update books set deleted_at = \\$1, updated_at = \\$1 where id = \\$2").WithArgs(sqlmock.AnyArg(), 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into audit_logs").
+		WithArgs(2, "admin@example.com", "book.delete", "book", 5, sqlmock.AnyArg(), "192.0.2.1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/books/delete", strings.NewReader(`{"id": 5}`))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req = testApp.contextSetUser(req, &data.User{ID: 2, Email: "admin@example.com"})
+
+	http.HandlerFunc(testApp.DeleteBook).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Error("DeleteBook returned wrong status code of", rr.Code, rr.Body.String())
+	}
+}
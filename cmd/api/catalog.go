@@ -0,0 +1,189 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/storage"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// catalogCacheControl lets clients keep catalog responses, as long as they check
+	// with us before using them. With an ETag that check is cheap.
+	catalogCacheControl = "no-cache"
+
+	// immutableCacheControl is for content addressed files, which never change
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+// catalogCache returns the caching headers for a catalog response in format. When the
+// client's copy is still current it writes 304 Not Modified instead, and returns true.
+func (app *application) catalogCache(w http.ResponseWriter, r *http.Request, format string) (http.Header, bool) {
+	headers := make(http.Header)
+	headers.Set("Vary", "Accept")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return headers, false
+	}
+
+	// the validator is derived from when the catalog last changed, so it can be checked
+	// without loading the catalog itself
+	state, err := app.models.Book.CatalogState(r.Context())
+	if err != nil {
+		// not being able to cache is no reason to fail the request
+		app.logger.ErrorContext(r.Context(), "cannot get catalog state", "error", err)
+		return headers, false
+	}
+
+	// cover urls which expire are part of the response too, and change with their window
+	var window int64
+	if expiring, ok := app.store.(storage.ExpiringURLs); ok {
+		window = expiring.URLWindow().Unix()
+	}
+
+	// the tag is strong, so every representation gets its own: each format, and each
+	// content coding Compress may send it in
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d|%d|%d|%d|%d",
+		r.URL.Path, format, contentCoding(r), state.UpdatedAt.UnixNano(), state.Books, state.Authors, state.Genres, window)))
+	tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	headers.Set("ETag", tag)
+	headers.Set("Cache-Control", catalogCacheControl)
+
+	if !etagMatches(r.Header.Get("If-None-Match"), tag) {
+		return headers, false
+	}
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.WriteHeader(http.StatusNotModified)
+
+	return headers, true
+}
+
+// etagMatches reports whether an If-None-Match header matches tag. If-None-Match uses
+// the weak comparison, so W/ prefixes are ignored.
+func etagMatches(ifNoneMatch, tag string) bool {
+	ifNoneMatch = strings.TrimSpace(ifNoneMatch)
+	if ifNoneMatch == "" {
+		return false
+	}
+	if ifNoneMatch == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// staticCacheControl sets Cache-Control on files served from /static. Covers stored by
+// hash never change, so clients may keep them forever. Anything else, like covers from
+// before they were stored by hash, has to be revalidated.
+func staticCacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := catalogCacheControl
+		if coverKeyPattern.MatchString(strings.TrimPrefix(r.URL.Path, "/")) {
+			value = immutableCacheControl
+		}
+
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: value}, r)
+	})
+}
+
+// cacheControlWriter only sets Cache-Control on successful responses, so a cover that
+// doesn't exist (yet) isn't cached as missing for a year
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status < http.StatusBadRequest {
+		w.Header().Set("Cache-Control", w.value)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Authors lists every author in the catalog, as JSON, CSV or NDJSON
+func (app *application) Authors(w http.ResponseWriter, r *http.Request) {
+	format := negotiateFormat(r, listFormats...)
+
+	headers, fresh := app.catalogCache(w, r, format)
+	if fresh {
+		return
+	}
+
+	authors, err := app.models.Author.All(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if format != formatJSON {
+		_ = writeList(w, http.StatusOK, format, "authors", authors, authorCSVColumns, headers)
+		return
+	}
+
+	payload := jsonResponse{
+		Error: false,
+		Data:  envelope{"authors": authors},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload, headers)
+}
+
+// Genres lists every genre in the catalog, as JSON, CSV or NDJSON
+func (app *application) Genres(w http.ResponseWriter, r *http.Request) {
+	format := negotiateFormat(r, listFormats...)
+
+	headers, fresh := app.catalogCache(w, r, format)
+	if fresh {
+		return
+	}
+
+	genres, err := app.models.Genre.All(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if format != formatJSON {
+		_ = writeList(w, http.StatusOK, format, "genres", genres, genreCSVColumns, headers)
+		return
+	}
+
+	payload := jsonResponse{
+		Error: false,
+		Data:  envelope{"genres": genres},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload, headers)
+}
+
+// CacheStats reports how well the catalog cache is doing
+func (app *application) CacheStats(w http.ResponseWriter, r *http.Request) {
+	payload := jsonResponse{
+		Error: false,
+		Data:  data.CacheStats(),
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
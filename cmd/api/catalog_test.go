@@ -0,0 +1,294 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/storage"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var catalogStateColumns = []string{"greatest", "books", "authors", "genres"}
+
+func TestApplication_AllBooks_NotModified(t *testing.T) {
+	mock := newMockDB(t)
+	changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// first request, the client has nothing cached
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 6, 1, 4))
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/books", nil)
+	http.HandlerFunc(testApp.AllBooks).ServeHTTP(rr, req)
+
+	tag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || tag == "" || strings.HasPrefix(tag, "W/") {
+		t.Fatalf("expected 200 with a strong ETag, got %d and %q", rr.Code, tag)
+	}
+	if rr.Header().Get("Cache-Control") != catalogCacheControl {
+		t.Errorf("unexpected Cache-Control %q", rr.Header().Get("Cache-Control"))
+	}
+
+	// nothing changed, so the books aren't even loaded
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 6, 1, 4))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/books", nil)
+	req.Header.Set("If-None-Match", `"something-else", `+tag)
+	http.HandlerFunc(testApp.AllBooks).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 || rr.Header().Get("ETag") != tag {
+		t.Fatalf("expected an empty 304 with the same ETag, got %d", rr.Code)
+	}
+
+	// a book was deleted, which changes the count
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 5, 1, 4))
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns))
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/books", nil)
+	req.Header.Set("If-None-Match", tag)
+	http.HandlerFunc(testApp.AllBooks).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == tag {
+		t.Errorf("expected 200 with a new ETag, got %d and %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
+
+func TestApplication_AllBooks_CompressedNotModified(t *testing.T) {
+	mock := newMockDB(t)
+	changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := testApp.Compress(http.HandlerFunc(testApp.AllBooks))
+
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 1, 1, 0))
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns).
+		AddRow(5, "It", 1, 1986, "it", strings.Repeat("A clown. ", 2*compressMinSize), changed, changed, 1, "", 1, "Stephen King", changed, changed))
+	mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/books", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rr, req)
+
+	tag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a compressed 200, got %d with %q", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+	if tag == "" || strings.HasPrefix(tag, "W/") {
+		t.Errorf("expected the compressed response to keep a strong ETag, got %q", tag)
+	}
+
+	// the 304 stands for the compressed response, so it has the very same tag
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 1, 1, 0))
+
+	rr = httptest.NewRecorder()
+	req.Header.Set("If-None-Match", tag)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified || rr.Header().Get("ETag") != tag {
+		t.Errorf("expected a 304 with ETag %s, got %d with %q", tag, rr.Code, rr.Header().Get("ETag"))
+	}
+
+	// the uncompressed response is another representation, with a tag of its own
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 1, 1, 0))
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns).
+		AddRow(5, "It", 1, 1986, "it", strings.Repeat("A clown. ", 2*compressMinSize), changed, changed, 1, "", 1, "Stephen King", changed, changed))
+	mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+
+	rr = httptest.NewRecorder()
+	req.Header.Del("Accept-Encoding")
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "" || rr.Header().Get("ETag") == tag {
+		t.Errorf("expected an uncompressed 200 with another ETag, got %d with %q and %q",
+			rr.Code, rr.Header().Get("Content-Encoding"), rr.Header().Get("ETag"))
+	}
+}
+
+// expiringStore is a store whose urls are replaced when window moves on
+type expiringStore struct {
+	storage.BlobStore
+	window time.Time
+}
+
+func (s *expiringStore) URLWindow() time.Time {
+	return s.window
+}
+
+func TestApplication_AllBooks_ETagFollowsURLWindow(t *testing.T) {
+	mock := newMockDB(t)
+	changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	store := &expiringStore{BlobStore: testApp.store, window: changed}
+	oldStore := testApp.store
+	testApp.store = store
+	t.Cleanup(func() { testApp.store = oldStore })
+
+	getBooks := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/books", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		http.HandlerFunc(testApp.AllBooks).ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 0, 0, 0))
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns))
+	tag := getBooks("").Header().Get("ETag")
+
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 0, 0, 0))
+	if rr := getBooks(tag); rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 within the same window, got %d", rr.Code)
+	}
+
+	// the catalog didn't change, but the cover urls the client has did
+	store.window = changed.Add(time.Hour)
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 0, 0, 0))
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns))
+
+	if rr := getBooks(tag); rr.Code != http.StatusOK || rr.Header().Get("ETag") == tag {
+		t.Errorf("expected 200 with a new ETag in the next window, got %d and %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
+
+func TestApplication_Genres_ETagPerResource(t *testing.T) {
+	mock := newMockDB(t)
+	changed := time.Now()
+
+	tags := make(map[string]bool)
+	for _, e := range []struct {
+		handler http.HandlerFunc
+		path    string
+		query   string
+	}{
+		{testApp.Genres, "/genres", "from genres"},
+		{testApp.Authors, "/authors", "from authors"},
+	} {
+		mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 6, 1, 4))
+		mock.ExpectQuery(e.query).WillReturnRows(sqlmock.NewRows([]string{"id", "name", "created_at", "updated_at"}).AddRow(1, "Horror", changed, changed))
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", e.path, nil)
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s returned %d", e.path, rr.Code)
+		}
+		tags[rr.Header().Get("ETag")] = true
+	}
+
+	if len(tags) != 2 {
+		t.Errorf("expected every resource to have its own ETag, got %v", tags)
+	}
+}
+
+func TestStaticCacheControl(t *testing.T) {
+	dir := t.TempDir()
+	hash := strings.Repeat("c", 64)
+	_ = os.Mkdir(filepath.Join(dir, "covers"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "covers", hash+"-small.jpg"), []byte("x"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "covers", "it.jpg"), []byte("x"), 0644)
+
+	handler := http.StripPrefix("/static", staticCacheControl(http.FileServer(http.Dir(dir))))
+
+	var tests = []struct {
+		path         string
+		expectedCode int
+		expected     string
+	}{
+		{"/static/covers/" + hash + "-small.jpg", http.StatusOK, immutableCacheControl},
+		{"/static/covers/it.jpg", http.StatusOK, catalogCacheControl},
+		{"/static/covers/" + hash + "-large.jpg", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", e.path, nil)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode || rr.Header().Get("Cache-Control") != e.expected {
+			t.Errorf("%s: expected %d with %q, got %d with %q", e.path, e.expectedCode, e.expected, rr.Code, rr.Header().Get("Cache-Control"))
+		}
+	}
+}
+
+func TestApplication_CatalogCache(t *testing.T) {
+	mock := newMockDB(t)
+	data.ConfigureCache(100, time.Minute)
+	t.Cleanup(func() { data.ConfigureCache(0, 0) })
+
+	before := data.CacheStats()
+
+	getBooks := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/books", nil)
+		http.HandlerFunc(testApp.AllBooks).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// only the first read goes to the database
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns).
+		AddRow(5, "It", 1, 1986, "it", "", time.Now(), time.Now(), 1, strings.Repeat("a", 64), 1, "Stephen King", time.Now(), time.Now()))
+	mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+
+	for i := 0; i < 3; i++ {
+		if rr := getBooks(); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/static/covers/") {
+			t.Fatalf("expected the book with its covers, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	// deleting a book drops the cache here, and tells the other instances about it
+	mock.ExpectExec("update books set deleted_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("select pg_notify").WithArgs(data.CacheChannel, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := testApp.models.Book.DeleteByID(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns))
+	getBooks()
+
+	// another instance changed the catalog
+	data.CacheNotified("some-other-instance")
+
+	mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns))
+	getBooks()
+
+	stats := data.CacheStats()
+	if hits, misses := stats.Hits-before.Hits, stats.Misses-before.Misses; hits != 2 || misses != 3 {
+		t.Errorf("expected 2 hits and 3 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestApplication_BookByID_SkipsCache(t *testing.T) {
+	mock := newMockDB(t)
+	data.ConfigureCache(100, time.Minute)
+	t.Cleanup(func() { data.ConfigureCache(0, 0) })
+
+	before := data.CacheStats()
+
+	// admins read a book by id to change it, so every read sees the saved version
+	for version := 1; version <= 2; version++ {
+		expectBookByID(mock, version)
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/books/5", nil)
+		withURLParam(testApp.BookByID, "id", "5").ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("ETag"); got != etag(version) {
+			t.Errorf("expected ETag %s, got %s", etag(version), got)
+		}
+	}
+
+	if stats := data.CacheStats(); stats != before {
+		t.Errorf("expected the cache to be left alone, got %+v", stats)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const clientIPContextKey = contextKey("client_ip")
+
+// ClientIP works out the ip address of the client, for clientIP. When the request comes
+// from one of the trusted proxies, X-Forwarded-For is read from the right, skipping our
+// own proxies, and the first address left is the client's. Anything further left was
+// sent by the client, so can't be believed.
+func (app *application) ClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+
+		if app.trustedProxy(ip) {
+			hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+				if err != nil {
+					break
+				}
+				ip = hop.Unmap()
+				if !app.trustedProxy(ip) {
+					break
+				}
+			}
+		}
+
+		if ip.IsValid() {
+			r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey, ip.String()))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the ip address the request came from
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// remoteIP returns the address of whoever connected to us
+func remoteIP(r *http.Request) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		addr, _ := netip.ParseAddr(r.RemoteAddr)
+		return addr.Unmap()
+	}
+	return addrPort.Addr().Unmap()
+}
+
+func (app *application) trustedProxy(ip netip.Addr) bool {
+	for _, prefix := range app.config.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads a comma separated list of addresses and CIDR ranges
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a CIDR range", field)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
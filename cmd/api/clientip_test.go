@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApplication_ClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := testApp
+	app.config.trustedProxies = proxies
+
+	var tests = []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{"direct", "198.51.100.7:1234", "", "198.51.100.7"},
+		{"untrusted proxy", "198.51.100.7:1234", "203.0.113.5", "198.51.100.7"},
+		{"trusted proxy", "10.1.2.3:1234", "203.0.113.5", "203.0.113.5"},
+		{"proxy chain", "10.1.2.3:1234", "203.0.113.5, 192.0.2.10", "203.0.113.5"},
+		{"spoofed hop", "10.1.2.3:1234", "1.1.1.1, 203.0.113.5", "203.0.113.5"},
+		{"garbage", "10.1.2.3:1234", "nonsense", "10.1.2.3"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		if e.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", e.forwardedFor)
+		}
+
+		var got string
+		app.ClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = clientIP(r)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+
+		if got != e.expected {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expected, got)
+		}
+	}
+}
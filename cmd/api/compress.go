@@ -0,0 +1,281 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinSize is the smallest response which is compressed. Below it the headers
+// and framing of the encoding cost about as much as they save.
+const compressMinSize = 1024
+
+// compressEncodings are the content codings we can send, most preferred first
+var compressEncodings = []string{"br", "gzip"}
+
+// compressor is what gzip.Writer and brotli.Writer have in common
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var compressors = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	}},
+}
+
+// Compress compresses responses with brotli or gzip, whichever the client prefers. Only
+// text, like JSON and CSV, is compressed, and only when there is at least compressMinSize
+// of it. Responses which already have a Content-Encoding, like /metrics, are left alone.
+func (app *application) Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		if r.Header.Get("Range") == "" {
+			cw.encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+
+		// handlers with strong ETags need to know, since each coding is its own representation
+		ctx := context.WithValue(r.Context(), contentCodingContextKey, cw.encoding)
+
+		next.ServeHTTP(cw, r.WithContext(ctx))
+
+		if err := cw.close(); err != nil {
+			app.logger.ErrorContext(r.Context(), "cannot finish compressed response", "error", err)
+		}
+	})
+}
+
+// contentCoding returns the content coding Compress will use for the response to r if it
+// is large enough, or an empty string when it won't compress it
+func contentCoding(r *http.Request) string {
+	encoding, _ := r.Context().Value(contentCodingContextKey).(string)
+	return encoding
+}
+
+// negotiateEncoding returns the content coding in compressEncodings which Accept-Encoding
+// prefers, or an empty string when it accepts none of them
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, encoding := range compressEncodings {
+		if q := encodingQuality(acceptEncoding, encoding); q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// encodingQuality is the qvalue Accept-Encoding gives encoding, either by name or with *
+func encodingQuality(acceptEncoding, encoding string) float64 {
+	q := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		value := 1.0
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err != nil {
+				continue
+			}
+			value = parsed
+		}
+
+		if name == encoding {
+			return value
+		}
+		q = value
+	}
+	return q
+}
+
+// compressible reports whether responses of contentType are worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether it is large
+// enough to compress, and then either compresses it or passes it through as it is
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // the coding the client prefers, empty when it accepts none we have
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool       // the header has been written, compressed or not
+	enc     compressor // set when the response is being compressed
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status) // informational, the real one is still to come
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+
+	if cw.encoding == "" || !cw.candidate() {
+		_ = cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= compressMinSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what has been written so far. Responses which are flushed are being
+// streamed, so they are compressed even when the first part is small.
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		_ = cw.decide(true)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// candidate reports whether the response can be compressed, going by its status and
+// the headers set so far. Its size is only known once it has been written.
+func (cw *compressWriter) candidate() bool {
+	if cw.head || cw.status < http.StatusOK || cw.status == http.StatusNoContent ||
+		cw.status == http.StatusPartialContent || cw.status == http.StatusNotModified {
+		return false
+	}
+
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if contentType := h.Get("Content-Type"); contentType != "" && !compressible(contentType) {
+		return false
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < compressMinSize {
+		return false
+	}
+	return true
+}
+
+// decide writes the header, compressed when compress is true and the response allows
+// it, followed by anything which has been held back
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if cw.candidate() {
+		// whether or not this one is compressed, the next one may be
+		h.Add("Vary", "Accept-Encoding")
+
+		if compress && cw.encoding != "" {
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+
+			cw.enc = compressors[cw.encoding].Get().(compressor)
+			cw.enc.Reset(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close writes out a response which was too small to compress, or finishes the
+// compressed one
+func (cw *compressWriter) close() error {
+	if cw.status == 0 {
+		return nil // nothing was written, so net/http sends an empty 200
+	}
+
+	if !cw.decided {
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+
+	if cw.enc == nil {
+		return nil
+	}
+
+	err := cw.enc.Close()
+	cw.enc.Reset(io.Discard)
+	compressors[cw.encoding].Put(cw.enc)
+	cw.enc = nil
+	return err
+}
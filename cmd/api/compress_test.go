@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func Test_negotiateEncoding(t *testing.T) {
+	var tests = []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+		{"GZIP", "gzip"},
+	}
+
+	for _, e := range tests {
+		if got := negotiateEncoding(e.acceptEncoding); got != e.expected {
+			t.Errorf("%q: expected %q, got %q", e.acceptEncoding, e.expected, got)
+		}
+	}
+}
+
+func TestApplication_Compress(t *testing.T) {
+	large := `{"books": "` + strings.Repeat("a", 4*compressMinSize) + `"}`
+
+	var tests = []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		expected       string
+	}{
+		{"gzip", "gzip", "application/json", large, "gzip"},
+		{"brotli", "gzip, br", "application/json", large, "br"},
+		{"too small", "gzip, br", "application/json", `{"error": false}`, ""},
+		{"not accepted", "", "application/json", large, ""},
+		{"image", "gzip, br", "image/jpeg", large, ""},
+		{"sniffed", "gzip", "", strings.Repeat("plain text ", compressMinSize), "gzip"},
+	}
+
+	for _, e := range tests {
+		handler := testApp.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if e.contentType != "" {
+				w.Header().Set("Content-Type", e.contentType)
+			}
+			w.Header().Set("ETag", `"1"`)
+			// in pieces, like an encoder would
+			for i := 0; i < len(e.body); i += 100 {
+				_, _ = io.WriteString(w, e.body[i:min(i+100, len(e.body))])
+			}
+		}))
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/books", nil)
+		req.Header.Set("Accept-Encoding", e.acceptEncoding)
+		handler.ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("Content-Encoding"); got != e.expected {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", e.name, e.expected, got)
+			continue
+		}
+
+		var body io.Reader = rr.Body
+		switch e.expected {
+		case "gzip":
+			zr, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(e.name, err)
+			}
+			body = zr
+		case "br":
+			body = brotli.NewReader(rr.Body)
+		}
+
+		b, err := io.ReadAll(body)
+		if err != nil || string(b) != e.body {
+			t.Errorf("%s: body didn't survive the round trip: %v", e.name, err)
+		}
+
+		if e.expected != "" {
+			if rr.Header().Get("ETag") != `"1"` {
+				t.Errorf("%s: expected the ETag to be left alone, got %q", e.name, rr.Header().Get("ETag"))
+			}
+			if rr.Body.Len() >= len(e.body) {
+				t.Errorf("%s: expected a smaller body, got %d bytes", e.name, rr.Body.Len())
+			}
+		}
+
+		if vary := rr.Header().Get("Vary"); (e.contentType != "image/jpeg") != strings.Contains(vary, "Accept-Encoding") {
+			t.Errorf("%s: unexpected Vary %q", e.name, vary)
+		}
+	}
+}
+
+func TestApplication_Compress_LeavesAlone(t *testing.T) {
+	large := strings.Repeat("a", 4*compressMinSize)
+
+	var tests = []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{"already encoded", "GET", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = io.WriteString(w, large)
+		}},
+		{"not modified", "GET", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		}},
+		{"partial", "GET", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-4095/10000")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = io.WriteString(w, large)
+		}},
+		{"head", "HEAD", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+		}},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(e.method, "/books", nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		testApp.Compress(e.handler).ServeHTTP(rr, req)
+
+		if e.name != "already encoded" && rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: expected no compression, got %q", e.name, rr.Header().Get("Content-Encoding"))
+		}
+		if e.method == "GET" && rr.Code == http.StatusOK && rr.Body.String() != large {
+			t.Errorf("%s: body was changed", e.name)
+		}
+	}
+}
+
+func TestApplication_Compress_Flush(t *testing.T) {
+	flushed := make(chan struct{})
+	proceed := make(chan struct{})
+
+	handler := testApp.Compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", formatNDJSON)
+		_, _ = io.WriteString(w, `{"id":1}`+"\n")
+		w.(http.Flusher).Flush()
+		close(flushed)
+		<-proceed
+		_, _ = io.WriteString(w, `{"id":2}`+"\n")
+	}))
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	<-flushed
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a streamed response to be compressed, got %q", res.Header.Get("Content-Encoding"))
+	}
+
+	// the first line arrives before the handler is done
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := make([]byte, len(`{"id":1}`+"\n"))
+	if _, err := io.ReadFull(zr, line); err != nil || string(line) != `{"id":1}`+"\n" {
+		t.Fatalf("expected the first line, got %q and %v", line, err)
+	}
+
+	close(proceed)
+	rest, _ := io.ReadAll(zr)
+	if string(rest) != `{"id":2}`+"\n" {
+		t.Errorf("expected the second line, got %q", rest)
+	}
+}
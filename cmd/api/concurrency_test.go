@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectBookByID tells mock to return book 5 at the given version
+func expectBookByID(mock sqlmock.Sqlmock, version int) {
+	expectBookWithCover(mock, version, "")
+}
+
+// expectBookWithCover expects book 5 to be loaded, pointing at the cover with hash
+func expectBookWithCover(mock sqlmock.Sqlmock, version int, hash string) {
+	mock.ExpectQuery("where b.id = \\$1").WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(bookColumns).AddRow(5, "It", 1, 1986, "it", "", time.Now(), time.Now(), version, hash, 1, "Stephen King", time.Now(), time.Now()))
+	mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+}
+
+func TestApplication_BookByID_ETag(t *testing.T) {
+	mock := newMockDB(t)
+	expectBookByID(mock, 3)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/books/5", nil)
+	withURLParam(testApp.BookByID, "id", "5").ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("ETag"); got != `"3"` {
+		t.Errorf(`expected ETag "3" but got %s`, got)
+	}
+}
+
+func TestApplication_EditBook_IfMatch(t *testing.T) {
+	var tests = []struct {
+		name         string
+		ifMatch      string
+		expectUpdate bool
+		rowsAffected int64
+		expectedCode int
+	}{
+		{"missing If-Match", "", false, 0, http.StatusPreconditionRequired},
+		{"stale version", `"2"`, false, 0, http.StatusPreconditionFailed},
+		{"lost race", `"3"`, true, 0, http.StatusPreconditionFailed},
+		{"current version", `"3"`, true, 1, http.StatusAccepted},
+		{"any version", `*`, true, 1, http.StatusAccepted},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			expectBookByID(mock, 3)
+
+			if e.expectUpdate {
+				mock.ExpectExec("update books set").
+					WithArgs("It", 1, 1986, "it", "", sqlmock.AnyArg(), 5, 3).
+					WillReturnResult(sqlmock.NewResult(0, e.rowsAffected))
+
+				// either way the book is reloaded, to send back the latest copy or for the audit log
+				expectBookByID(mock, 4)
+				if e.rowsAffected > 0 {
+					mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/admin/books/save", strings.NewReader(`{"id": 5, "title": "It", "author_id": 1, "publication_year": 1986}`))
+			if e.ifMatch != "" {
+				req.Header.Set("If-Match", e.ifMatch)
+			}
+			http.HandlerFunc(testApp.EditBook).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+
+			if rr.Code == http.StatusPreconditionFailed && rr.Header().Get("ETag") == "" {
+				t.Error("expected the current ETag with a 412")
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"context"
+	"net/http"
+)
+
+// contextKey is used for the values we store in a request's context, so they
+// can't collide with keys from other packages
+type contextKey string
+
+const (
+	userContextKey          = contextKey("user")
+	apiVersionContextKey    = contextKey("api_version")
+	contentCodingContextKey = contextKey("content_coding")
+)
+
+// contextSetUser returns a copy of r with the authenticated user added to its context
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser returns the authenticated user for r, or nil on routes that
+// don't require authentication
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/covers"
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/storage"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxCoverUploadBytes is the most we read from an upload request. It leaves some room
+// for the multipart framing around the image itself.
+const maxCoverUploadBytes = covers.MaxBytes + 1<<20
+
+// coverGCGrace is how old an unreferenced rendition has to be before garbage collection
+// removes it. Renditions are stored before the book is pointed at them, so a younger one
+// may belong to an upload which is still in progress. That is also why a cover a book
+// stops using isn't deleted right away: another upload of the same cover may have just
+// stored it again, and be about to point a book at it.
+const coverGCGrace = time.Hour
+
+// coverKeyPattern matches the keys of renditions stored by hash
+var coverKeyPattern = regexp.MustCompile(`^covers/([0-9a-f]{64})-(small|medium|large)\.jpg$`)
+
+// legacyCoverPattern matches the keys covers were stored under before content addressing,
+// by the slug of their book. migrateLegacyCovers moves them to hash keys.
+var legacyCoverPattern = regexp.MustCompile(`^covers/([^/]+)\.jpg$`)
+
+// coverKey is the key one rendition of a cover is stored under. Covers are addressed by
+// the hash of their content, so a key never changes what it points at, and renaming a
+// book doesn't touch its cover.
+func coverKey(hash string, size covers.Size) string {
+	return fmt.Sprintf("covers/%s-%s.jpg", hash, size)
+}
+
+// storeCover validates an uploaded cover, stores all of its renditions, and returns the
+// hash they are stored under
+func (app *application) storeCover(ctx context.Context, src io.ReadSeeker) (string, error) {
+	renditions, err := covers.Process(src)
+	if err != nil {
+		return "", err
+	}
+
+	// the renditions are generated deterministically, so the largest one identifies the cover
+	sum := sha256.Sum256(renditions[len(renditions)-1].Data)
+	hash := hex.EncodeToString(sum[:])
+
+	for _, rendition := range renditions {
+		err := app.store.Put(ctx, coverKey(hash, rendition.Size), bytes.NewReader(rendition.Data), int64(len(rendition.Data)), "image/jpeg")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hash, nil
+}
+
+// withCoverURLs fills in the cover urls of every book that has a cover
+func (app *application) withCoverURLs(books ...*data.Book) {
+	for _, book := range books {
+		if book == nil || book.CoverHash == "" {
+			continue
+		}
+
+		book.Covers = make(map[string]string)
+		for _, size := range covers.Sizes {
+			book.Covers[string(size)] = app.store.URL(coverKey(book.CoverHash, size))
+		}
+	}
+}
+
+// coverError writes the response for an error from storeCover
+func (app *application) coverError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		app.errorJSON(w, r, covers.ErrTooLarge, http.StatusRequestEntityTooLarge)
+	case errors.Is(err, covers.ErrTooLarge):
+		app.errorJSON(w, r, err, http.StatusRequestEntityTooLarge)
+	case errors.Is(err, covers.ErrTooManyPixels), errors.Is(err, covers.ErrUnsupportedFormat):
+		app.errorJSON(w, r, err, http.StatusUnprocessableEntity)
+	default:
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+	}
+}
+
+// UploadCover replaces the cover of a book. The image can either be the whole request body,
+// or the "cover" field of a multipart/form-data form. Either way it is streamed to a
+// temporary file instead of being held in memory.
+func (app *application) UploadCover(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	book, err := app.models.Book.GetOneById(r.Context(), bookID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCoverUploadBytes)
+
+	src, err := coverUploadReader(r)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "cover-*")
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, src)
+	if err != nil {
+		app.coverError(w, r, err)
+		return
+	}
+	coverUploadBytes.Observe(float64(n))
+
+	hash, err := app.storeCover(r.Context(), tmp)
+	if err != nil {
+		app.coverError(w, r, err)
+		return
+	}
+
+	previous, err := app.models.Book.SetCover(r.Context(), book.ID, hash)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	book.CoverHash = hash
+
+	app.audit(r, "book.cover_update", "book", book.ID, envelope{"cover_hash": previous}, envelope{"cover_hash": hash})
+	app.withCoverURLs(book)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Cover saved",
+		Data:    envelope{"covers": book.Covers},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// coverUploadReader returns the image being uploaded in r, without reading it into memory
+func coverUploadReader(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no cover field in form")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "cover" {
+			return part, nil
+		}
+	}
+}
+
+// DeleteCover removes the cover of a book
+func (app *application) DeleteCover(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	book, err := app.models.Book.GetOneById(r.Context(), bookID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if book.CoverHash == "" {
+		app.errorJSON(w, r, errors.New("book has no cover"), http.StatusNotFound)
+		return
+	}
+
+	previous, err := app.models.Book.SetCover(r.Context(), book.ID, "")
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	app.audit(r, "book.cover_delete", "book", book.ID, envelope{"cover_hash": previous}, nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Cover deleted",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// missingCover is a book which points at a cover that isn't (completely) stored
+type missingCover struct {
+	BookID int      `json:"book_id"`
+	Slug   string   `json:"slug"`
+	Hash   string   `json:"cover_hash"`
+	Sizes  []string `json:"sizes"`
+}
+
+// coverReport compares the covers books point at with what is in the store
+type coverReport struct {
+	Orphaned []storage.Blob `json:"orphaned"` // renditions no book points at, and migrated legacy covers
+	Missing  []missingCover `json:"missing"`  // renditions books point at, which aren't stored
+	Legacy   []string       `json:"legacy"`   // keys which predate content addressing and may still be used, never collected
+}
+
+// legacyCovers returns the books a legacy cover may still belong to, by slug: those
+// without a cover hash, whose slug the cover was stored under
+func (app *application) legacyCovers(ctx context.Context) (map[string][]*data.Book, error) {
+	books, err := app.models.Book.GetWithoutCovers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bySlug := make(map[string][]*data.Book)
+	for _, book := range books {
+		bySlug[book.Slug] = append(bySlug[book.Slug], book)
+	}
+	return bySlug, nil
+}
+
+// checkCovers builds a coverReport. Books in the trash count as using their cover, since
+// they get it back when restored. A legacy cover is orphaned once every book with its slug
+// has a cover hash, which migrateLegacyCovers gives them.
+func (app *application) checkCovers(ctx context.Context) (*coverReport, error) {
+	blobs, err := app.store.List(ctx, "covers/")
+	if err != nil {
+		return nil, err
+	}
+
+	books, err := app.models.Book.GetWithCovers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, book := range books {
+		referenced[book.CoverHash] = true
+	}
+
+	report := &coverReport{Orphaned: []storage.Blob{}, Missing: []missingCover{}, Legacy: []string{}}
+	stored := make(map[string]bool)
+
+	// only looked up if there are legacy covers, which there aren't once they are migrated
+	var legacy map[string][]*data.Book
+
+	for _, blob := range blobs {
+		match := coverKeyPattern.FindStringSubmatch(blob.Key)
+		switch {
+		case match == nil:
+			slug := legacyCoverPattern.FindStringSubmatch(blob.Key)
+			if slug == nil {
+				report.Legacy = append(report.Legacy, blob.Key)
+				continue
+			}
+
+			if legacy == nil {
+				legacy, err = app.legacyCovers(ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if len(legacy[slug[1]]) > 0 {
+				report.Legacy = append(report.Legacy, blob.Key)
+			} else {
+				report.Orphaned = append(report.Orphaned, blob)
+			}
+		case !referenced[match[1]]:
+			report.Orphaned = append(report.Orphaned, blob)
+		default:
+			stored[blob.Key] = true
+		}
+	}
+
+	for _, book := range books {
+		var missing []string
+		for _, size := range covers.Sizes {
+			if !stored[coverKey(book.CoverHash, size)] {
+				missing = append(missing, string(size))
+			}
+		}
+
+		if len(missing) > 0 {
+			report.Missing = append(report.Missing, missingCover{BookID: book.ID, Slug: book.Slug, Hash: book.CoverHash, Sizes: missing})
+		}
+	}
+
+	return report, nil
+}
+
+// collectCovers deletes orphaned renditions older than coverGCGrace, and returns their keys
+func (app *application) collectCovers(ctx context.Context) ([]string, error) {
+	report, err := app.checkCovers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, blob := range report.Orphaned {
+		if time.Since(blob.ModTime) < coverGCGrace {
+			continue
+		}
+
+		err := app.store.Delete(ctx, blob.Key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return removed, err
+		}
+		removed = append(removed, blob.Key)
+	}
+
+	return removed, nil
+}
+
+// coverMigration is the outcome of migrateLegacyCovers
+type coverMigration struct {
+	Migrated map[string]string `json:"migrated"` // the hash each legacy cover is now stored under
+	Failed   map[string]string `json:"failed"`   // why a legacy cover couldn't be migrated
+}
+
+// migrateLegacyCovers stores every cover kept under the slug of its book the way uploads
+// are stored now, by hash, and points the books with that slug and no cover hash at it.
+// The legacy keys are then orphaned, and left for garbage collection. A cover which isn't
+// a valid image any more is reported and left where it is.
+func (app *application) migrateLegacyCovers(ctx context.Context) (*coverMigration, error) {
+	blobs, err := app.store.List(ctx, "covers/")
+	if err != nil {
+		return nil, err
+	}
+
+	legacy, err := app.legacyCovers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	migration := &coverMigration{Migrated: map[string]string{}, Failed: map[string]string{}}
+
+	for _, blob := range blobs {
+		if coverKeyPattern.MatchString(blob.Key) {
+			continue
+		}
+		slug := legacyCoverPattern.FindStringSubmatch(blob.Key)
+		if slug == nil || len(legacy[slug[1]]) == 0 {
+			continue
+		}
+
+		hash, err := app.storeLegacyCover(ctx, blob.Key)
+		switch {
+		case errors.Is(err, covers.ErrTooLarge), errors.Is(err, covers.ErrTooManyPixels), errors.Is(err, covers.ErrUnsupportedFormat):
+			migration.Failed[blob.Key] = err.Error()
+			continue
+		case err != nil:
+			return migration, err
+		}
+
+		for _, book := range legacy[slug[1]] {
+			if _, err := app.models.Book.SetLegacyCover(ctx, book.ID, hash); err != nil {
+				return migration, err
+			}
+		}
+		migration.Migrated[blob.Key] = hash
+	}
+
+	return migration, nil
+}
+
+// storeLegacyCover stores the cover under key by hash, like an upload, and returns the hash
+func (app *application) storeLegacyCover(ctx context.Context, key string) (string, error) {
+	src, err := app.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "cover-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// one byte more than is allowed is enough for Process to turn it down
+	if _, err := io.Copy(tmp, io.LimitReader(src, covers.MaxBytes+1)); err != nil {
+		return "", err
+	}
+
+	return app.storeCover(ctx, tmp)
+}
+
+// CoverReport lists orphaned and missing covers
+func (app *application) CoverReport(w http.ResponseWriter, r *http.Request) {
+	report, err := app.checkCovers(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error: false,
+		Data:  report,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// CollectCovers garbage collects orphaned covers right away, instead of waiting for the next purge
+func (app *application) CollectCovers(w http.ResponseWriter, r *http.Request) {
+	removed, err := app.collectCovers(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(removed) > 0 {
+		app.audit(r, "cover.collect", "cover", 0, nil, envelope{"removed": removed})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Removed %d orphaned renditions", len(removed)),
+		Data:    envelope{"removed": removed},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// MigrateCovers moves covers stored by slug, from before covers were stored by hash, to
+// hash keys, so the books they belong to get their cover urls back
+func (app *application) MigrateCovers(w http.ResponseWriter, r *http.Request) {
+	migration, err := app.migrateLegacyCovers(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	if len(migration.Migrated) > 0 {
+		app.audit(r, "cover.migrate", "cover", 0, nil, envelope{"migrated": migration.Migrated})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Migrated %d covers", len(migration.Migrated)),
+		Data:    migration,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
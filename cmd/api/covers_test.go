@@ -0,0 +1,426 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/covers"
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/storage"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// useTempStaticPath points staticPath, and the cover store, at an empty directory for the duration of a test
+func useTempStaticPath(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "covers"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old, oldStore := staticPath, testApp.store
+	staticPath = dir
+	testApp.store = storage.NewLocal(dir, "/static/")
+	t.Cleanup(func() { staticPath, testApp.store = old, oldStore })
+
+	return dir
+}
+
+// testPNG returns a png of the given size
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, x%height, color.NRGBA{R: 200, A: 255})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// storedCovers returns the keys of every rendition in the cover store
+func storedCovers(t *testing.T) []string {
+	blobs, err := testApp.store.List(context.Background(), "covers/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, blob := range blobs {
+		keys = append(keys, blob.Key)
+	}
+	return keys
+}
+
+// writeCover stores every rendition of a fake cover with hash, last modified at modTime
+func writeCover(t *testing.T, dir, hash string, modTime time.Time, sizes ...string) {
+	for _, size := range sizes {
+		path := filepath.Join(dir, "covers", hash+"-"+size+".jpg")
+		if err := os.WriteFile(path, []byte("x"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(path, modTime, modTime)
+	}
+}
+
+// writeLegacyCover stores a cover by slug, the way covers were stored before they were
+// stored by hash
+func writeLegacyCover(t *testing.T, dir, slug string, content []byte, modTime time.Time) {
+	path := filepath.Join(dir, "covers", slug+".jpg")
+	if err := os.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, modTime, modTime)
+}
+
+var setCoverColumns = []string{"coalesce"}
+
+func TestApplication_EditBook_Cover(t *testing.T) {
+	var tests = []struct {
+		name         string
+		cover        []byte
+		expectedCode int
+	}{
+		{"png cover", testPNG(t, 1000, 1500), http.StatusAccepted},
+		{"not an image", []byte("<html>definitely a cover</html>"), http.StatusUnprocessableEntity},
+		{"too many pixels", testPNG(t, 7000, 10), http.StatusUnprocessableEntity},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			dir := useTempStaticPath(t)
+			mock := newMockDB(t)
+
+			if e.expectedCode == http.StatusAccepted {
+				mock.ExpectQuery("insert into books").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+				expectBookByID(mock, 1)
+				mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("update books b set cover_hash").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 5).
+					WillReturnRows(sqlmock.NewRows(setCoverColumns).AddRow(""))
+			}
+
+			body := fmt.Sprintf(`{"title": "It", "author_id": 1, "publication_year": 1986, "cover": %q}`, base64.StdEncoding.EncodeToString(e.cover))
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/admin/books/save", strings.NewReader(body))
+			http.HandlerFunc(testApp.EditBook).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Fatalf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+
+			keys := storedCovers(t)
+			if e.expectedCode != http.StatusAccepted {
+				if len(keys) > 0 {
+					t.Errorf("expected no cover files to be written, found %v", keys)
+				}
+				return
+			}
+
+			// every rendition is a jpeg stored under the hash of the cover, no wider than its size allows
+			if len(keys) != 3 || !coverKeyPattern.MatchString(keys[0]) {
+				t.Fatalf("expected three renditions stored by hash, got %v", keys)
+			}
+			hash := coverKeyPattern.FindStringSubmatch(keys[0])[1]
+
+			for size, width := range map[string]int{"small": 200, "medium": 400, "large": 800} {
+				f, err := os.Open(filepath.Join(dir, "covers", hash+"-"+size+".jpg"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cfg, err := jpeg.DecodeConfig(f)
+				f.Close()
+				if err != nil {
+					t.Fatalf("%s rendition is not a jpeg: %s", size, err)
+				}
+
+				if cfg.Width != width || cfg.Height != width*3/2 {
+					t.Errorf("%s rendition is %dx%d", size, cfg.Width, cfg.Height)
+				}
+			}
+		})
+	}
+}
+
+func TestApplication_withCoverURLs(t *testing.T) {
+	useTempStaticPath(t)
+
+	book := &data.Book{Slug: "it", CoverHash: "abc"}
+	other := &data.Book{Slug: "the-stand"}
+	testApp.withCoverURLs(book, other)
+
+	if book.Covers["small"] != "/static/covers/abc-small.jpg" {
+		t.Errorf("unexpected cover urls %v", book.Covers)
+	}
+
+	if other.Covers != nil {
+		t.Errorf("expected no cover urls for a book without a cover, got %v", other.Covers)
+	}
+}
+
+func TestApplication_UploadCover(t *testing.T) {
+	cover := testPNG(t, 300, 450)
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	_ = mw.WriteField("note", "fields before the file are skipped")
+	fw, _ := mw.CreateFormFile("cover", "it.png")
+	_, _ = fw.Write(cover)
+	_ = mw.Close()
+
+	var tests = []struct {
+		name         string
+		contentType  string
+		body         io.Reader
+		expectedCode int
+	}{
+		{"multipart form", mw.FormDataContentType(), &multipartBody, http.StatusOK},
+		{"raw body", "image/png", bytes.NewReader(cover), http.StatusOK},
+		{"lying about the type", "image/png", strings.NewReader("GIF89a but not really"), http.StatusUnprocessableEntity},
+		{"too large", "image/jpeg", bytes.NewReader(make([]byte, maxCoverUploadBytes+1)), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			useTempStaticPath(t)
+			mock := newMockDB(t)
+			expectBookByID(mock, 1)
+			if e.expectedCode == http.StatusOK {
+				mock.ExpectQuery("update books b set cover_hash").WillReturnRows(sqlmock.NewRows(setCoverColumns).AddRow(""))
+				mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("PUT", "/admin/books/5/cover", e.body)
+			req.Header.Set("Content-Type", e.contentType)
+			withURLParam(testApp.UploadCover, "id", "5").ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Fatalf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+
+			if saved := len(storedCovers(t)) == 3; saved != (e.expectedCode == http.StatusOK) {
+				t.Errorf("expected cover saved to be %t", !saved)
+			}
+		})
+	}
+}
+
+func TestApplication_UploadCover_ReplacesPrevious(t *testing.T) {
+	dir := useTempStaticPath(t)
+	old := strings.Repeat("a", 64)
+	writeCover(t, dir, old, time.Now().Add(-2*coverGCGrace), "small", "medium", "large")
+
+	mock := newMockDB(t)
+	expectBookWithCover(mock, 1, old)
+	mock.ExpectQuery("update books b set cover_hash").WillReturnRows(sqlmock.NewRows(setCoverColumns).AddRow(old))
+	mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/admin/books/5/cover", bytes.NewReader(testPNG(t, 300, 450)))
+	withURLParam(testApp.UploadCover, "id", "5").ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// another upload of the old cover could be about to use it again, so it is left for
+	// garbage collection, which only takes it once nothing points at it
+	if keys := storedCovers(t); len(keys) != 6 {
+		t.Errorf("expected the old renditions to be left, got %v", keys)
+	}
+
+	mock.ExpectQuery("where cover_hash is not null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "cover_hash", "deleted_at"}))
+	if _, err := testApp.collectCovers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range storedCovers(t) {
+		if strings.Contains(key, old) {
+			t.Errorf("expected %s to be collected", key)
+		}
+	}
+}
+
+func TestApplication_DeleteCover(t *testing.T) {
+	dir := useTempStaticPath(t)
+	hash := strings.Repeat("b", 64)
+	writeCover(t, dir, hash, time.Now(), "small", "medium", "large")
+
+	mock := newMockDB(t)
+	expectBookWithCover(mock, 1, hash)
+	mock.ExpectQuery("update books b set cover_hash").WithArgs("", sqlmock.AnyArg(), 5).
+		WillReturnRows(sqlmock.NewRows(setCoverColumns).AddRow(hash))
+	mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+	expectBookByID(mock, 1)
+
+	for _, expectedCode := range []int{http.StatusOK, http.StatusNotFound} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/admin/books/5/cover", nil)
+		withURLParam(testApp.DeleteCover, "id", "5").ServeHTTP(rr, req)
+
+		if rr.Code != expectedCode {
+			t.Errorf("expected %d but got %d", expectedCode, rr.Code)
+		}
+	}
+
+	// the renditions are left for garbage collection
+	if keys := storedCovers(t); len(keys) != 3 {
+		t.Errorf("expected the renditions to be left, got %v", keys)
+	}
+}
+
+func TestApplication_CollectCovers(t *testing.T) {
+	dir := useTempStaticPath(t)
+
+	kept := strings.Repeat("1", 64)       // a book points at it
+	trashed := strings.Repeat("2", 64)    // a book in the trash points at it
+	incomplete := strings.Repeat("3", 64) // a book points at it, but a rendition is missing
+	stale := strings.Repeat("4", 64)      // nothing points at it, for long enough to collect it
+	fresh := strings.Repeat("5", 64)      // nothing points at it, but it might be an upload in progress
+
+	longAgo := time.Now().Add(-2 * coverGCGrace)
+	writeCover(t, dir, kept, longAgo, "small", "medium", "large")
+	writeCover(t, dir, trashed, longAgo, "small", "medium", "large")
+	writeCover(t, dir, incomplete, longAgo, "small", "large")
+	writeCover(t, dir, stale, longAgo, "small", "medium", "large")
+	writeCover(t, dir, fresh, time.Now(), "small", "medium", "large")
+
+	// stored by slug, before content addressing. It has been migrated, since its book has a
+	// hash now, and Misery hasn't, so its cover is still needed.
+	writeLegacyCover(t, dir, "it", []byte("x"), longAgo)
+	writeLegacyCover(t, dir, "misery", []byte("x"), longAgo)
+
+	mock := newMockDB(t)
+	expectBooksWithCovers := func() {
+		mock.ExpectQuery("where cover_hash is not null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "cover_hash", "deleted_at"}).
+			AddRow(1, "it", kept, nil).
+			AddRow(2, "the-stand", trashed, time.Now()).
+			AddRow(3, "carrie", incomplete, nil))
+		mock.ExpectQuery("where cover_hash is null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).
+			AddRow(4, "misery", nil))
+	}
+
+	expectBooksWithCovers()
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/covers/report", nil)
+	http.HandlerFunc(testApp.CoverReport).ServeHTTP(rr, req)
+
+	var report struct {
+		Data struct {
+			Orphaned []struct {
+				Key string `json:"Key"`
+			} `json:"orphaned"`
+			Missing []missingCover `json:"missing"`
+			Legacy  []string       `json:"legacy"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&report)
+
+	if len(report.Data.Orphaned) != 7 {
+		t.Errorf("expected the stale and fresh renditions, and covers/it.jpg, to be orphaned, got %+v", report.Data.Orphaned)
+	}
+	if len(report.Data.Missing) != 1 || report.Data.Missing[0].BookID != 3 || report.Data.Missing[0].Sizes[0] != "medium" {
+		t.Errorf("expected the medium rendition of book 3 to be missing, got %+v", report.Data.Missing)
+	}
+	if len(report.Data.Legacy) != 1 || report.Data.Legacy[0] != "covers/misery.jpg" {
+		t.Errorf("expected covers/misery.jpg to be reported as legacy, got %v", report.Data.Legacy)
+	}
+
+	expectBooksWithCovers()
+	mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/admin/covers/gc", nil)
+	http.HandlerFunc(testApp.CollectCovers).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d", rr.Code)
+	}
+
+	for _, key := range storedCovers(t) {
+		if strings.Contains(key, stale) || key == "covers/it.jpg" {
+			t.Errorf("expected %s to be collected", key)
+		}
+	}
+	if keys := storedCovers(t); len(keys) != 12 {
+		t.Errorf("expected only the stale renditions to be collected, %d left", len(keys))
+	}
+}
+
+func TestApplication_MigrateCovers(t *testing.T) {
+	dir := useTempStaticPath(t)
+	longAgo := time.Now().Add(-2 * coverGCGrace)
+
+	writeLegacyCover(t, dir, "it", testPNG(t, 300, 450), longAgo)
+	writeLegacyCover(t, dir, "broken", []byte("not an image"), longAgo)
+	writeLegacyCover(t, dir, "gone", testPNG(t, 300, 450), longAgo) // its book was deleted
+
+	mock := newMockDB(t)
+
+	// It is in the catalog and in the trash, under the same slug
+	mock.ExpectQuery("where cover_hash is null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).
+		AddRow(5, "it", nil).
+		AddRow(6, "broken", nil).
+		AddRow(7, "it", time.Now()))
+	mock.ExpectExec("update books set cover_hash").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 5).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update books set cover_hash").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/covers/migrate", nil)
+	http.HandlerFunc(testApp.MigrateCovers).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var payload struct {
+		Data coverMigration `json:"data"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+	hash := payload.Data.Migrated["covers/it.jpg"]
+	if len(payload.Data.Migrated) != 1 || hash == "" {
+		t.Fatalf("expected covers/it.jpg to be migrated, got %v", payload.Data.Migrated)
+	}
+	if _, ok := payload.Data.Failed["covers/broken.jpg"]; !ok || len(payload.Data.Failed) != 1 {
+		t.Errorf("expected covers/broken.jpg to fail, got %v", payload.Data.Failed)
+	}
+	for _, size := range covers.Sizes {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(coverKey(hash, size)))); err != nil {
+			t.Errorf("expected the %s rendition to be stored: %v", size, err)
+		}
+	}
+
+	// once migrated, the legacy cover is collected, along with the one nobody uses
+	mock.ExpectQuery("where cover_hash is not null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "cover_hash", "deleted_at"}).
+		AddRow(5, "it", hash, nil).
+		AddRow(7, "it", hash, time.Now()))
+	mock.ExpectQuery("where cover_hash is null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).
+		AddRow(6, "broken", nil))
+
+	removed, err := testApp.collectCovers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0] != "covers/gone.jpg" || removed[1] != "covers/it.jpg" {
+		t.Errorf("expected covers/gone.jpg and covers/it.jpg to be collected, got %v", removed)
+	}
+}
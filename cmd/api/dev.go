@@ -0,0 +1,161 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	devTokenTTL    = time.Hour          // how long minted tokens last, unless asked otherwise
+	maxDevTokenTTL = 7 * 24 * time.Hour // so a forgotten token doesn't last forever
+)
+
+// devUserRequest is a test user to add. Only the email is needed.
+type devUserRequest struct {
+	Email     string `json:"email" validate:"required,email,max=255"`
+	FirstName string `json:"first_name" validate:"max=255"`
+	LastName  string `json:"last_name" validate:"max=255"`
+	Password  string `json:"password" validate:"max=72"` // "password" when not given
+}
+
+// devTokenRequest picks the user to mint a token for, by id or by email
+type devTokenRequest struct {
+	UserID int    `json:"user_id" validate:"min=1"`
+	Email  string `json:"email" validate:"email"`
+	TTL    string `json:"ttl"` // a duration like "30m", devTokenTTL when not given
+}
+
+func (t devTokenRequest) Validate(v *validator.Validator) {
+	v.Check(t.UserID != 0 || t.Email != "", "user_id", "required", "or email must be given")
+
+	if t.TTL != "" {
+		ttl, err := time.ParseDuration(t.TTL)
+		v.Check(err == nil && ttl > 0 && ttl <= maxDevTokenTTL, "ttl", "invalid", "must be a duration up to "+maxDevTokenTTL.String())
+	}
+}
+
+// devRoutes are tools for working on the api locally. They let anyone act as any user,
+// so they are only mounted in development, and checkDevRoutes stops the server from
+// starting if they are served anywhere else.
+func (app *application) devRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Post("/users", app.DevAddUser)
+	mux.Post("/tokens", app.DevMintToken)
+	return mux
+}
+
+// checkDevRoutes returns an error if routes serves the development routes outside of development
+func checkDevRoutes(environment string, routes chi.Routes) error {
+	if environment == "development" {
+		return nil
+	}
+
+	return chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if route == "/dev" || strings.HasPrefix(route, "/dev/") {
+			return fmt.Errorf("refusing to serve the development route %s %s in environment %q", method, route, environment)
+		}
+		return nil
+	})
+}
+
+// DevAddUser adds an active test user
+func (app *application) DevAddUser(w http.ResponseWriter, r *http.Request) {
+	var req devUserRequest
+	if err := app.readJSON(w, r, &req); err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if req.Password == "" {
+		req.Password = "password"
+	}
+
+	u := data.User{
+		Email:     req.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Password:  req.Password,
+		Active:    1,
+	}
+
+	id, err := app.models.User.Insert(r.Context(), u)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	user, err := app.models.User.GetOne(r.Context(), id)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	user.Password = ""
+
+	app.logger.WarnContext(r.Context(), "added test user", "user_id", id)
+	app.audit(r, "dev.user_create", "user", id, nil, user)
+
+	_ = app.writeJSON(w, http.StatusCreated, jsonResponse{Error: false, Message: "test user added", Data: user})
+}
+
+// DevMintToken saves a token for any user, so requests can be made as them. Like logging
+// in, it replaces the user's other tokens.
+func (app *application) DevMintToken(w http.ResponseWriter, r *http.Request) {
+	var req devTokenRequest
+	if err := app.readJSON(w, r, &req); err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	ttl := devTokenTTL
+	if req.TTL != "" {
+		ttl, _ = time.ParseDuration(req.TTL) // checked by Validate
+	}
+
+	var user *data.User
+	var err error
+	if req.UserID != 0 {
+		user, err = app.models.User.GetOne(r.Context(), req.UserID)
+	} else {
+		user, err = app.models.User.GetByEmail(r.Context(), req.Email)
+	}
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if user.Active == 0 {
+		app.errorJSON(w, r, errors.New("the user is inactive, so the token wouldn't work"))
+		return
+	}
+
+	token, err := app.models.Token.GenerateToken(user.ID, ttl)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if err := app.models.Token.Insert(r.Context(), *token, *user); err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	token.Email = user.Email
+	user.Password = ""
+
+	app.logger.WarnContext(r.Context(), "minted token", "user_id", user.ID, "ttl", ttl.String())
+	app.audit(r, "dev.token_mint", "user", user.ID, nil, nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "send it as Authorization: Bearer <token> to act as " + user.Email,
+		Data:    envelope{"token": token, "user": user},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
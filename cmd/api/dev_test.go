@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_checkDevRoutes(t *testing.T) {
+	production := testApp
+	production.environment = "production"
+
+	if err := checkDevRoutes("production", production.routes().(chi.Routes)); err != nil {
+		t.Errorf("expected production routes to pass, got %v", err)
+	}
+
+	// the routes of a development build must not be served anywhere else
+	development := testApp.routes().(chi.Routes)
+	if err := checkDevRoutes("development", development); err != nil {
+		t.Errorf("expected development routes to pass in development, got %v", err)
+	}
+	if err := checkDevRoutes("production", development); err == nil {
+		t.Error("expected development routes to be refused in production")
+	}
+}
+
+func TestRoutes_DevOnlyInDevelopment(t *testing.T) {
+	production := testApp
+	production.environment = "production"
+
+	for _, path := range []string{"/dev/tokens", "/test-generate-token", "/users/add"} {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(`{"user_id": 2}`))
+		production.routes().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound && rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected %s not to be served in production, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestApplication_DevMintToken(t *testing.T) {
+	var tests = []struct {
+		name         string
+		body         string
+		expectMint   bool
+		expectedCode int
+	}{
+		{"by id", `{"user_id": 2, "ttl": "30m"}`, true, http.StatusCreated},
+		{"nobody", `{"ttl": "30m"}`, false, http.StatusUnprocessableEntity},
+		{"too long", `{"user_id": 2, "ttl": "720h"}`, false, http.StatusUnprocessableEntity},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			if e.expectMint {
+				mock.ExpectQuery("from users where id = \\$1").WithArgs(2).
+					WillReturnRows(sqlmock.NewRows(userColumns).AddRow(2, "admin@example.com", "Admin", "User", "hash", 1, time.Now(), time.Now(), 1))
+				mock.ExpectExec("delete\\s+from tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("insert into tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/dev/tokens", strings.NewReader(e.body))
+			http.HandlerFunc(testApp.DevMintToken).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+
+			var payload struct {
+				Data struct {
+					User map[string]interface{} `json:"user"`
+				} `json:"data"`
+			}
+			_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+			if password, _ := payload.Data.User["password"].(string); password != "" {
+				t.Errorf("expected no password hash to be sent, got %q", password)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportExtensions is the file extension of an export in each format
+var exportExtensions = map[string]string{
+	formatJSON:   "json",
+	formatCSV:    "csv",
+	formatNDJSON: "ndjson",
+}
+
+// exportedUser is a user as exports have them, in every format. Unlike data.User it has
+// no password or token, not even empty ones.
+type exportedUser struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Active    int       `json:"active"`
+	LoggedIn  int       `json:"logged_in"` // 1 when the user has a token which hasn't expired
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var userCSVColumns = []column[*exportedUser]{
+	{"id", func(u *exportedUser) string { return strconv.Itoa(u.ID) }},
+	{"email", func(u *exportedUser) string { return u.Email }},
+	{"first_name", func(u *exportedUser) string { return u.FirstName }},
+	{"last_name", func(u *exportedUser) string { return u.LastName }},
+	{"active", func(u *exportedUser) string { return strconv.Itoa(u.Active) }},
+	{"logged_in", func(u *exportedUser) string { return strconv.Itoa(u.LoggedIn) }},
+	{"created_at", func(u *exportedUser) string { return u.CreatedAt.Format(time.RFC3339) }},
+	{"updated_at", func(u *exportedUser) string { return u.UpdatedAt.Format(time.RFC3339) }},
+}
+
+// export streams a listing to the client as its rows are read. Nothing is sent until the
+// first row arrives, so an export which fails before then still gets an error response.
+type export[T any] struct {
+	w       http.ResponseWriter
+	format  string
+	name    string
+	columns []column[T]
+	lw      *listWriter[T]
+}
+
+func newExport[T any](w http.ResponseWriter, r *http.Request, name string, columns []column[T]) *export[T] {
+	return &export[T]{w: w, format: negotiateFormat(r, listFormats...), name: name, columns: columns}
+}
+
+func (e *export[T]) write(item T) error {
+	if e.lw == nil {
+		e.start()
+	}
+	return e.lw.write(item)
+}
+
+func (e *export[T]) start() {
+	h := e.w.Header()
+	h.Set("Content-Type", formatContentTypes[e.format])
+	h.Set("Content-Disposition", `attachment; filename="`+e.name+"."+exportExtensions[e.format]+`"`)
+	h.Set("Cache-Control", "no-store")
+	h.Add("Vary", "Accept")
+	e.w.WriteHeader(http.StatusOK)
+
+	e.lw = newListWriter(e.w, e.format, e.name, e.columns)
+}
+
+// finish ends the export, with err being what reading the rows returned
+func (e *export[T]) finish(app *application, r *http.Request, err error) {
+	if err != nil && e.lw == nil {
+		app.errorJSON(e.w, r, err)
+		return
+	}
+
+	if err != nil {
+		// the status is long gone, so all that's left is to break off the response. The
+		// client then sees the transfer fail, instead of taking part of the export for all of it.
+		app.logger.ErrorContext(r.Context(), "export failed", "export", e.name, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	if e.lw == nil {
+		e.start() // there were no rows
+	}
+	if err := e.lw.flush(); err != nil {
+		app.logger.ErrorContext(r.Context(), "cannot finish export", "export", e.name, "error", err)
+	}
+}
+
+// ExportBooks sends every book in the catalog, as JSON, CSV or NDJSON. The books are
+// written as they are read, so the size of the catalog doesn't matter.
+func (app *application) ExportBooks(w http.ResponseWriter, r *http.Request) {
+	e := newExport(w, r, "books", bookCSVColumns)
+
+	err := app.models.Book.Each(r.Context(), func(book *data.Book) error {
+		app.withCoverURLs(book)
+		return e.write(book)
+	})
+
+	e.finish(app, r, err)
+}
+
+// ExportUsers sends every user, as JSON, CSV or NDJSON, written as they are read. Since
+// that is everyone's email address, exports are audited.
+func (app *application) ExportUsers(w http.ResponseWriter, r *http.Request) {
+	e := newExport(w, r, "users", userCSVColumns)
+
+	var exported exportedUser
+	err := app.models.User.Each(r.Context(), func(user *data.User) error {
+		exported = exportedUser{
+			ID:        user.ID,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Active:    user.Active,
+			LoggedIn:  user.Token.ID,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+		}
+		return e.write(&exported)
+	})
+
+	e.finish(app, r, err)
+	if err == nil {
+		app.audit(r, "user.export", "user", 0, nil, nil)
+	}
+}
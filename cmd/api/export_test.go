@@ -0,0 +1,259 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var exportBookColumns = append(append([]string{}, bookColumns...), "id", "genre_name", "created_at", "updated_at")
+
+func TestApplication_ExportBooks(t *testing.T) {
+	mock := newMockDB(t)
+	now := time.Now()
+
+	// It has two genres, so two rows, and Misery has none
+	mock.ExpectQuery("left join books_genres").WillReturnRows(sqlmock.NewRows(exportBookColumns).
+		AddRow(5, "It", 1, 1986, "it", "", now, now, 1, "", 1, "Stephen King", now, now, 1, "Horror", now, now).
+		AddRow(5, "It", 1, 1986, "it", "", now, now, 1, "", 1, "Stephen King", now, now, 2, "Thriller", now, now).
+		AddRow(6, "Misery", 1, 1987, "misery", "", now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/books/export", nil)
+	http.HandlerFunc(testApp.ExportBooks).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Disposition") != `attachment; filename="books.json"` {
+		t.Errorf("unexpected Content-Disposition %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	var payload struct {
+		Error bool `json:"error"`
+		Data  struct {
+			Books []data.Book `json:"books"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal("export isn't valid json:", err)
+	}
+
+	books := payload.Data.Books
+	if len(books) != 2 || books[0].Title != "It" || books[1].Title != "Misery" {
+		t.Fatalf("expected It and Misery, got %+v", books)
+	}
+	if len(books[0].Genres) != 2 || books[0].Genres[1].GenreName != "Thriller" {
+		t.Errorf("expected It to have both its genres, got %+v", books[0].Genres)
+	}
+	if len(books[1].Genres) != 0 {
+		t.Errorf("expected Misery to have no genres, got %+v", books[1].Genres)
+	}
+}
+
+func TestApplication_ExportBooks_Empty(t *testing.T) {
+	mock := newMockDB(t)
+
+	for accept, expected := range map[string]string{
+		"application/json":     `{"error":false,"message":"success","data":{"books":[]}}` + "\n",
+		"application/x-ndjson": "",
+	} {
+		mock.ExpectQuery("left join books_genres").WillReturnRows(sqlmock.NewRows(exportBookColumns))
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/books/export", nil)
+		req.Header.Set("Accept", accept)
+		http.HandlerFunc(testApp.ExportBooks).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %d: %q", accept, expected, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestApplication_ExportUsers_CSV(t *testing.T) {
+	mock := newMockDB(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mock.ExpectQuery("from users where deleted_at is null").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "email", "first_name", "last_name", "user_active", "created_at", "updated_at", "version", "has_token"}).
+			AddRow(1, "admin@example.com", "Ada", "Admin", 1, created, created, 1, 1).
+			AddRow(2, "bob@example.com", "Bob", "=Builder", 0, created, created, 1, 0))
+	mock.ExpectExec("insert into audit_logs").
+		WithArgs(2, "admin@example.com", "user.export", "user", 0, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/users/export", nil)
+	req.Header.Set("Accept", "text/csv")
+	req = testApp.contextSetUser(req, &data.User{ID: 2, Email: "admin@example.com"})
+	http.HandlerFunc(testApp.ExportUsers).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Disposition") != `attachment; filename="users.csv"` {
+		t.Fatalf("expected a csv attachment, got %d with %q", rr.Code, rr.Header().Get("Content-Disposition"))
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"id", "email", "first_name", "last_name", "active", "logged_in", "created_at", "updated_at"},
+		{"1", "admin@example.com", "Ada", "Admin", "1", "1", "2024-01-02T03:04:05Z", "2024-01-02T03:04:05Z"},
+		{"2", "bob@example.com", "Bob", "'=Builder", "0", "0", "2024-01-02T03:04:05Z", "2024-01-02T03:04:05Z"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %v", len(expected), records)
+	}
+	for i := range expected {
+		for j := range expected[i] {
+			if records[i][j] != expected[i][j] {
+				t.Errorf("record %d: expected %v, got %v", i, expected[i], records[i])
+				break
+			}
+		}
+	}
+}
+
+func TestApplication_ExportUsers_JSON(t *testing.T) {
+	mock := newMockDB(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, accept := range []string{"application/json", "application/x-ndjson"} {
+		mock.ExpectQuery("from users where deleted_at is null").WillReturnRows(
+			sqlmock.NewRows([]string{"id", "email", "first_name", "last_name", "user_active", "created_at", "updated_at", "version", "has_token"}).
+				AddRow(1, "admin@example.com", "Ada", "Admin", 1, created, created, 1, 1))
+		mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/users/export", nil)
+		req.Header.Set("Accept", accept)
+		req = testApp.contextSetUser(req, &data.User{ID: 2, Email: "admin@example.com"})
+		http.HandlerFunc(testApp.ExportUsers).ServeHTTP(rr, req)
+
+		line := rr.Body.Bytes()
+		if accept == "application/json" {
+			var payload struct {
+				Data struct {
+					Users []json.RawMessage `json:"users"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(line, &payload); err != nil || len(payload.Data.Users) != 1 {
+				t.Fatalf("%s: expected one user, got %s", accept, rr.Body.String())
+			}
+			line = payload.Data.Users[0]
+		}
+
+		var user map[string]interface{}
+		if err := json.Unmarshal(line, &user); err != nil {
+			t.Fatalf("%s: %v", accept, err)
+		}
+		for _, field := range []string{"password", "token"} {
+			if _, ok := user[field]; ok {
+				t.Errorf("%s: expected no %s field, got %v", accept, field, user)
+			}
+		}
+		if user["email"] != "admin@example.com" || user["logged_in"] != 1.0 {
+			t.Errorf("%s: unexpected user %v", accept, user)
+		}
+	}
+}
+
+func TestApplication_ExportBooks_Fails(t *testing.T) {
+	mock := newMockDB(t)
+	now := time.Now()
+
+	// before anything was sent, the client gets an error response
+	mock.ExpectQuery("left join books_genres").WillReturnError(errors.New("connection refused"))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/books/export", nil)
+	http.HandlerFunc(testApp.ExportBooks).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rr.Code)
+	}
+
+	// once the export is underway, the response is broken off. It has been sent by the time
+	// the third row fails, since the second row is another book.
+	mock.ExpectQuery("left join books_genres").WillReturnRows(sqlmock.NewRows(exportBookColumns).
+		AddRow(5, "It", 1, 1986, "it", "", now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil).
+		AddRow(6, "Misery", 1, 1987, "misery", "", now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil).
+		AddRow(7, "Carrie", 1, 1974, "carrie", "", now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil).
+		RowError(2, errors.New("connection reset")))
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected the handler to abort, got %v", p)
+		}
+	}()
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(testApp.ExportBooks).ServeHTTP(rr, req)
+	t.Error("expected the handler to abort")
+}
+
+func TestRoutes_ExportBooks_FailsHalfway(t *testing.T) {
+	mock := newMockDB(t)
+	now := time.Now()
+	token := strings.Repeat("A", 26)
+
+	// the first book is large enough, even compressed, that the start of the export has
+	// been sent when the third row fails
+	random := make([]byte, 128*1024)
+	_, _ = rand.Read(random)
+	description := hex.EncodeToString(random)
+
+	expectExport := func() {
+		mock.ExpectQuery("from tokens where token = \\$1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "email", "token", "token_hash", "created_at", "updated_at", "expiry"}).
+				AddRow(1, 2, "admin@example.com", token, []byte("hash"), now, now, now.Add(time.Hour)))
+		mock.ExpectQuery("from users where id = \\$1").
+			WillReturnRows(sqlmock.NewRows(userColumns).AddRow(2, "admin@example.com", "Admin", "User", "hash", 1, now, now, 1))
+		mock.ExpectQuery("left join books_genres").WillReturnRows(sqlmock.NewRows(exportBookColumns).
+			AddRow(5, "It", 1, 1986, "it", description, now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil).
+			AddRow(6, "Misery", 1, 1987, "misery", "", now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil).
+			AddRow(7, "Carrie", 1, 1974, "carrie", "", now, now, 1, "", 1, "Stephen King", now, now, nil, nil, nil, nil).
+			RowError(2, errors.New("connection reset")))
+	}
+
+	srv := httptest.NewServer(testApp.routes())
+	defer srv.Close()
+
+	// through every middleware, compression included, the client must not get what looks
+	// like a whole export
+	for _, encoding := range []string{"identity", "gzip"} {
+		expectExport()
+
+		req, _ := http.NewRequest("GET", srv.URL+"/v1/admin/books/export", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "text/csv")
+		req.Header.Set("Accept-Encoding", encoding) // set by hand, so the client leaves gzip alone
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected the export to start, got %d: %s", encoding, res.StatusCode, body)
+		}
+		if err == nil {
+			t.Errorf("%s: expected reading the export to fail, got %d bytes and no error", encoding, len(body))
+		}
+	}
+}
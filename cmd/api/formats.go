@@ -0,0 +1,213 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/covers"
+	"Bookstore-Backend/internal/data"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the formats listings can be sent in, by media type
+const (
+	formatJSON   = "application/json"
+	formatCSV    = "text/csv"
+	formatNDJSON = "application/x-ndjson"
+)
+
+// listFormats are the formats of the catalog listings, the default first
+var listFormats = []string{formatJSON, formatCSV, formatNDJSON}
+
+// formatContentTypes is the Content-Type sent for each format
+var formatContentTypes = map[string]string{
+	formatJSON:   formatJSON,
+	formatCSV:    "text/csv; charset=utf-8; header=present",
+	formatNDJSON: formatNDJSON,
+}
+
+// negotiateFormat returns the one of offers which the request's Accept header prefers.
+// Ties go to the earlier offer, and when nothing is acceptable the first offer is used
+// anyway, like it is when there is no Accept header at all.
+func negotiateFormat(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality is the qvalue Accept gives mediaType, from the most specific media
+// range which matches it
+func acceptQuality(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		s := 0
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case mediaRange == "*/*":
+			s = 0
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			s = 1
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity = s
+		q = 1
+		if value, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = value
+		}
+	}
+	return q
+}
+
+// column is one column of a listing sent as CSV
+type column[T any] struct {
+	name  string
+	value func(T) string
+}
+
+var bookCSVColumns = []column[*data.Book]{
+	{"id", func(b *data.Book) string { return strconv.Itoa(b.ID) }},
+	{"title", func(b *data.Book) string { return b.Title }},
+	{"slug", func(b *data.Book) string { return b.Slug }},
+	{"author_id", func(b *data.Book) string { return strconv.Itoa(b.AuthorID) }},
+	{"author_name", func(b *data.Book) string { return b.Author.AuthorName }},
+	{"publication_year", func(b *data.Book) string { return strconv.Itoa(b.PublicationYear) }},
+	{"genres", func(b *data.Book) string {
+		names := make([]string, len(b.Genres))
+		for i, genre := range b.Genres {
+			names[i] = genre.GenreName
+		}
+		return strings.Join(names, "; ")
+	}},
+	{"description", func(b *data.Book) string { return b.Description }},
+	{"cover", func(b *data.Book) string { return b.Covers[string(covers.Large)] }},
+	{"created_at", func(b *data.Book) string { return b.CreatedAt.Format(time.RFC3339) }},
+	{"updated_at", func(b *data.Book) string { return b.UpdatedAt.Format(time.RFC3339) }},
+}
+
+var authorCSVColumns = []column[*data.Author]{
+	{"id", func(a *data.Author) string { return strconv.Itoa(a.ID) }},
+	{"author_name", func(a *data.Author) string { return a.AuthorName }},
+	{"created_at", func(a *data.Author) string { return a.CreatedAt.Format(time.RFC3339) }},
+	{"updated_at", func(a *data.Author) string { return a.UpdatedAt.Format(time.RFC3339) }},
+}
+
+var genreCSVColumns = []column[*data.Genre]{
+	{"id", func(g *data.Genre) string { return strconv.Itoa(g.ID) }},
+	{"genre_name", func(g *data.Genre) string { return g.GenreName }},
+	{"created_at", func(g *data.Genre) string { return g.CreatedAt.Format(time.RFC3339) }},
+	{"updated_at", func(g *data.Genre) string { return g.UpdatedAt.Format(time.RFC3339) }},
+}
+
+// listWriter writes the items of a listing one at a time, so a listing of any size can be
+// sent without holding all of it. CSV has a header row, NDJSON has one json object per
+// line, and JSON is a jsonResponse with the items under name in its data.
+type listWriter[T any] struct {
+	w       io.Writer
+	format  string
+	columns []column[T]
+	csv     *csv.Writer
+	json    *json.Encoder
+	row     []string
+	count   int
+}
+
+func newListWriter[T any](w io.Writer, format, name string, columns []column[T]) *listWriter[T] {
+	lw := &listWriter[T]{w: w, format: format, columns: columns}
+
+	switch format {
+	case formatCSV:
+		lw.csv = csv.NewWriter(w)
+		lw.row = make([]string, len(columns))
+		for i, c := range columns {
+			lw.row[i] = c.name
+		}
+		_ = lw.csv.Write(lw.row) // errors are kept by the csv.Writer, and returned by flush
+	case formatJSON:
+		lw.json = json.NewEncoder(w)
+		_, _ = fmt.Fprintf(w, `{"error":false,"message":"success","data":{%q:[`, name)
+	default:
+		lw.json = json.NewEncoder(w)
+	}
+
+	return lw
+}
+
+func (lw *listWriter[T]) write(item T) error {
+	lw.count++
+
+	if lw.csv != nil {
+		for i, c := range lw.columns {
+			lw.row[i] = csvCell(c.value(item))
+		}
+		return lw.csv.Write(lw.row)
+	}
+
+	if lw.format == formatJSON && lw.count > 1 {
+		if _, err := io.WriteString(lw.w, ","); err != nil {
+			return err
+		}
+	}
+	return lw.json.Encode(item)
+}
+
+// flush writes whatever is still buffered, and closes the JSON document
+func (lw *listWriter[T]) flush() error {
+	switch lw.format {
+	case formatCSV:
+		lw.csv.Flush()
+		return lw.csv.Error()
+	case formatJSON:
+		_, err := io.WriteString(lw.w, "]}}\n")
+		return err
+	}
+	return nil
+}
+
+// csvCell keeps spreadsheets from taking a value for a formula, which someone could
+// use to run one on an analyst's machine by putting it in a title, say
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// writeList writes a listing in format, with the items under name for JSON. The catalog
+// only uses it for CSV and NDJSON, and writeJSON for JSON, like every other response.
+func writeList[T any](w http.ResponseWriter, status int, format, name string, items []T, columns []column[T], headers http.Header) error {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.WriteHeader(status)
+
+	lw := newListWriter(w, format, name, columns)
+	for _, item := range items {
+		if err := lw.write(item); err != nil {
+			return err
+		}
+	}
+	return lw.flush()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func Test_negotiateFormat(t *testing.T) {
+	var tests = []struct {
+		accept   string
+		expected string
+	}{
+		{"", formatJSON},
+		{"*/*", formatJSON},
+		{"text/csv", formatCSV},
+		{"application/x-ndjson", formatNDJSON},
+		{"text/*", formatCSV},
+		{"text/csv;q=0.5, application/json", formatJSON},
+		{"application/json;q=0.1, text/csv", formatCSV},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatJSON},
+		{"application/xml", formatJSON},
+		{"*/*;q=0.1, text/csv;q=0", formatJSON},
+		{"application/problem+json", formatJSON},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/books", nil)
+		req.Header.Set("Accept", e.accept)
+
+		if got := negotiateFormat(req, listFormats...); got != e.expected {
+			t.Errorf("%q: expected %s, got %s", e.accept, e.expected, got)
+		}
+	}
+}
+
+func Test_csvCell(t *testing.T) {
+	for value, expected := range map[string]string{
+		"It":                "It",
+		"":                  "",
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1":                "'+1",
+		"@SUM(A1)":          "'@SUM(A1)",
+	} {
+		if got := csvCell(value); got != expected {
+			t.Errorf("%q: expected %q, got %q", value, expected, got)
+		}
+	}
+}
+
+func TestApplication_AllBooks_Formats(t *testing.T) {
+	mock := newMockDB(t)
+	changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tags := make(map[string]bool)
+	for _, accept := range []string{"text/csv", "application/x-ndjson", "application/json"} {
+		mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 2, 1, 1))
+		mock.ExpectQuery("from books b").WillReturnRows(sqlmock.NewRows(bookColumns).
+			AddRow(5, "It", 1, 1986, "it", "A clown, \"Pennywise\"", changed, changed, 1, "", 1, "Stephen King", changed, changed).
+			AddRow(6, "=cmd", 1, 1987, "cmd", "", changed, changed, 1, "", 1, "Stephen King", changed, changed))
+		for i := 0; i < 2; i++ {
+			mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+		}
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/books", nil)
+		req.Header.Set("Accept", accept)
+		http.HandlerFunc(testApp.AllBooks).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", accept, rr.Code, rr.Body.String())
+		}
+		if !strings.HasPrefix(rr.Header().Get("Content-Type"), accept) {
+			t.Errorf("%s: unexpected Content-Type %q", accept, rr.Header().Get("Content-Type"))
+		}
+		if rr.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s: expected Vary: Accept, got %q", accept, rr.Header().Get("Vary"))
+		}
+		tags[rr.Header().Get("ETag")] = true
+
+		switch accept {
+		case "text/csv":
+			records, err := csv.NewReader(rr.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 3 || records[0][0] != "id" || records[0][1] != "title" {
+				t.Fatalf("expected a header and two rows, got %v", records)
+			}
+			if records[1][1] != "It" || records[1][4] != "Stephen King" || records[1][7] != `A clown, "Pennywise"` {
+				t.Errorf("unexpected row %v", records[1])
+			}
+			if records[2][1] != "'=cmd" {
+				t.Errorf("expected the formula to be escaped, got %q", records[2][1])
+			}
+		case "application/x-ndjson":
+			lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("expected two lines, got %q", rr.Body.String())
+			}
+			var book struct {
+				ID    int    `json:"id"`
+				Title string `json:"title"`
+			}
+			if err := json.Unmarshal([]byte(lines[1]), &book); err != nil || book.ID != 6 || book.Title != "=cmd" {
+				t.Errorf("unexpected line %q: %v", lines[1], err)
+			}
+		}
+	}
+
+	if len(tags) != 3 {
+		t.Errorf("expected every format to have its own ETag, got %v", tags)
+	}
+}
+
+func TestApplication_Genres_CSV(t *testing.T) {
+	mock := newMockDB(t)
+	changed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mock.ExpectQuery("select greatest").WillReturnRows(sqlmock.NewRows(catalogStateColumns).AddRow(changed, 2, 1, 1))
+	mock.ExpectQuery("from genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}).AddRow(1, "Horror", changed, changed))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/genres", nil)
+	req.Header.Set("Accept", "text/csv")
+	http.HandlerFunc(testApp.Genres).ServeHTTP(rr, req)
+
+	expected := "id,genre_name,created_at,updated_at\n1,Horror,2024-01-02T03:04:05Z,2024-01-02T03:04:05Z\n"
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("expected %q, got %d: %q", expected, rr.Code, rr.Body.String())
+	}
+}
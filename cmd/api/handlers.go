@@ -2,11 +2,12 @@ package main
 
 import (
 	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/validator"
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
@@ -20,38 +21,110 @@ var staticPath = "./static/"
 type jsonResponse struct {
 	Error   bool   `json:"error"`
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"` // stable and machine readable, set on errors
 	Data interface{} `json:"data,omitempty"`
 }
 
 type envelope map[string] interface{} // adding envolpe
 
-// Login is the handler used to attempt to log a user into the api
-func (app *application) Login(w http.ResponseWriter, r *http.Request) {
-	type credentials struct {
-		UserName string `json:"email"`
-		Password string `json:"password"`
+// credentials is what Login is sent
+type credentials struct {
+	UserName string `json:"email" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// tokenRequest is the body of the requests which act on a token
+type tokenRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+// idRequest is the body of the requests which act on a single record by id
+type idRequest struct {
+	ID int `json:"id" validate:"required,min=1"`
+}
+
+// bookRequest is what EditBook is sent. A book without an id is a new book.
+type bookRequest struct {
+	ID int `json:"id" validate:"min=1"`
+	Title string `json:"title" validate:"required,max=255"`
+	AuthorID int `json:"author_id" validate:"required,min=1"`
+	PublicationYear int `json:"publication_year" validate:"required,min=1"`
+	Description string `json:"description"`
+	CoverBase64 string `json:"cover"`
+	GenreIDs []int `json:"genre_ids"`
+}
+
+func (b bookRequest) Validate(v *validator.Validator) {
+	validatePublicationYear(v, b.PublicationYear)
+	validateGenreIDs(v, b.GenreIDs)
+}
+
+// validatePublicationYear makes sure a book wasn't published in the future
+func validatePublicationYear(v *validator.Validator, year int) {
+	if !v.HasError("publication_year") {
+		v.Check(year <= time.Now().Year(), "publication_year", "max", "must not be in the future")
+	}
+}
+
+// validateGenreIDs makes sure every genre id could be one
+func validateGenreIDs(v *validator.Validator, ids []int) {
+	for _, id := range ids {
+		if id < 1 {
+			v.Add("genre_ids", "min", "must all be at least 1")
+			return
+		}
+	}
+}
+
+// checkAuthor makes sure the author of a book exists, so a typo gets a clear answer
+// instead of a foreign key violation
+func (app *application) checkAuthor(ctx context.Context, v *validator.Validator, id int) {
+	if v.HasError("author_id") {
+		return
 	}
 
+	exists, err := app.models.Author.Exists(ctx, id)
+	if err != nil {
+		// the database still won't take the book, so this isn't worth failing over
+		app.logger.WarnContext(ctx, "cannot check author", "author_id", id, "error", err)
+		return
+	}
+
+	v.Check(exists, "author_id", "not_found", "must be an existing author")
+}
+
+// selectData is an option for a select input
+type selectData struct {
+	Value int `json:"value"`
+	Text string `json:"text"`
+}
+
+// Login is the handler used to attempt to log a user into the api
+func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	var creds credentials // It keeps a place for credentials
 	var payload jsonResponse
 
 	err := app.readJSON(w, r, &creds) // third one is what we wanna decode the json into
     if err != nil{
-		app.errorLog.Println(err)
-		payload.Error = true
-		payload.Message = "invalid json supplied, or json missing entirely"
-		_ = app.writeJSON(w, http.StatusBadRequest, payload)
+		app.logger.WarnContext(r.Context(), "invalid login request", "error", err)
+
+		var fields validator.Errors
+		if !errors.As(err, &fields) {
+			err = errors.New("invalid json supplied, or json missing entirely")
+		}
+		app.errorJSON(w, r, err)
+		return
 	}   
  
-	// TODO authenticate
-	app.infoLog.Println(creds.UserName, creds.Password)
+	app.logger.DebugContext(r.Context(), "login attempt", "email", creds.UserName)
 
     
 	// look up the user by email
 
-	user, err := app.models.User.GetByEmail(creds.UserName)
+	user, err := app.models.User.GetByEmail(r.Context(), creds.UserName)
 	if err != nil{
-		app.errorJSON(w, errors.New("invalid username/password"))
+		recordLogin("password", false)
+		app.errorJSON(w, r, errors.New("invalid username/password"))
 		return
 	}
 
@@ -59,7 +132,8 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 
 	validPassword, err := user.PasswordMatches(creds.Password)
 	if err != nil || !validPassword {
-		app.errorJSON(w, errors.New("invalid username/password"))
+		recordLogin("password", false)
+		app.errorJSON(w, r, errors.New("invalid username/password"))
 		return
 	}
 	
@@ -68,23 +142,17 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	// If user active and valid, generate a token
 
    if user.Active == 0 {
-	app.errorJSON(w, errors.New("user is not active"))
+	recordLogin("password", false)
+	app.errorJSON(w, r, errors.New("user is not active"))
 	return
    }
 
-	token, err := app.models.Token.GenerateToken(user.ID, 24 *time.Hour) // 24 hours expiry
+	token, err := app.newSession(r.Context(), user)
 	if err != nil{
-		app.errorJSON(w, err)
-		return
-	}
-
-	// save it to the db
-
-	err = app.models.Token.Insert(*token, *user)
-	if err != nil{
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
+	recordLogin("password", true)
 
 	// send back a response
 	payload = jsonResponse{
@@ -96,27 +164,40 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	// out, err := json.MarshalIndent(payload, "", "\t")
 	err = app.writeJSON(w, http.StatusOK, payload) // used instead of previos one
 	if err != nil {
-		app.errorLog.Println(err) 
+		app.logger.ErrorContext(r.Context(), "cannot write login response", "error", err)
 	}
 }
 
-func (app *application) Logout(w http.ResponseWriter, r *http.Request){
-	var requestPayload struct{
-		Token string `json:"token"`
+// newSession generates a token for a user who has proven who they are, and saves it to the db
+func (app *application) newSession(ctx context.Context, user *data.User) (*data.Token, error) {
+	token, err := app.models.Token.GenerateToken(user.ID, 24*time.Hour) // 24 hours expiry
+	if err != nil {
+		return nil, err
 	}
 
+	err = app.models.Token.Insert(ctx, *token, *user)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (app *application) Logout(w http.ResponseWriter, r *http.Request){
+	var requestPayload tokenRequest
+
 
 	err := app.readJSON(w, r, &requestPayload)
 	if err != nil{
-		app.errorJSON(w, errors.New("invalid json"))
+		app.errorJSON(w, r, errors.New("invalid json"))
 		return
 	}
 
 	// if we pass that
 
-	err = app.models.Token.DeleteByToken(requestPayload.Token)
+	err = app.models.Token.DeleteByToken(r.Context(), requestPayload.Token)
 	if err != nil{
-		app.errorJSON(w, errors.New("invalid json"))
+		app.errorJSON(w, r, errors.New("invalid json"))
 		return
 	}
 
@@ -130,9 +211,9 @@ func (app *application) Logout(w http.ResponseWriter, r *http.Request){
 }
 func (app *application) AllUsers(w http.ResponseWriter, r *http.Request){
 	var users data.User
-	all, err := users.GetAll()
+	all, err := users.GetAll(r.Context())
 	if err != nil {
-		app.errorLog.Println(err)
+		app.logger.ErrorContext(r.Context(), "cannot get users", "error", err)
 		return
 	}
 
@@ -148,45 +229,70 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request){
 	var user data.User
 	err := app.readJSON(w, r, &user)
 	if err != nil{
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
 	// what is the id of the in my json payload?
+	created := user.ID == 0
 
 	if user.ID == 0 { // 0 means it doesn't exist, then add.
 		// add user
-		if _, err := app.models.User.Insert(user); 
-		 err != nil {
-			app.errorJSON(w, err)
+		id, err := app.models.User.Insert(r.Context(), user)
+		if err != nil {
+			app.errorJSON(w, r, err)
 		return
 		}
+
+		user.ID = id
+		app.audit(r, "user.create", "user", id, nil, user)
 	} else{
 		// Edit user, u is for getting the user
-		u, err := app.models.User.GetOne(user.ID)
+		u, err := app.models.User.GetOne(r.Context(), user.ID)
 		if err != nil{
-			app.errorJSON(w, err)
+			app.errorJSON(w, r, err)
 		    return
 		}
 
+		current := *u
+		current.Password = ""
+		if !app.checkIfMatch(w, r, current, u.Version) {
+			return
+		}
+
+		before := *u
+
 		u.Email = user.Email
 		u.FirstName = user.FirstName
 		u.LastName = user.LastName
 		u.Active = user.Active
 
-		if err := u.Update();
+		if err := u.Update(r.Context());
 		 err != nil {
-			app.errorJSON(w, err)
+			if errors.Is(err, data.ErrEditConflict) {
+				// someone saved in between us reading and writing
+				if latest, err := app.models.User.GetOne(r.Context(), u.ID); err == nil {
+					latest.Password = ""
+					app.preconditionFailed(w, r, latest, latest.Version)
+					return
+				}
+			}
+			app.errorJSON(w, r, err)
 		    return
 		 }
 
+		 app.audit(r, "user.update", "user", u.ID, before, u)
+
 		 // if password != string, update password
 		 if user.Password != "" {
-			err := u.ResetPassword(user.Password)
+			err := u.ResetPassword(r.Context(), user.Password)
 			if err != nil{
-				app.errorJSON(w, err)
+				app.errorJSON(w, r, err)
 				return
 			}
+
+			// never put passwords, even hashed ones, in the audit log
+			app.audit(r, "user.password_reset", "user", u.ID, nil, nil)
 		 }
 	}
 
@@ -195,43 +301,56 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request){
 		Message: "Changes saved",
 	}
 
-	_ = app.writeJSON(w, http.StatusAccepted, payload)
+	_ = app.writeJSON(w, savedStatus(r, created), payload)
 
 }
 
 func (app *application) Getuser(w http.ResponseWriter, r *http.Request){
 	userId, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
-	user, err := app.models.User.GetOne(userId)
+	user, err := app.models.User.GetOne(r.Context(), userId)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	// the ETag has to be sent back in If-Match when saving the user
+	headers := make(http.Header)
+	headers.Set("ETag", etag(user.Version))
+
+	// version 1 sent the user on its own
+	if apiVersion(r) < 2 {
+		_ = app.writeJSON(w, http.StatusOK, user, headers)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, user)
+	_ = app.writeJSON(w, http.StatusOK, jsonResponse{Error: false, Data: user}, headers)
 }
 
 func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request){
-   var requestPaylaod struct {
-	ID int `json:"id"`
-   }
+   var requestPaylaod idRequest
 
    err := app.readJSON(w, r, &requestPaylaod)
    if err != nil{
-	app.errorJSON(w, err)
+	app.errorJSON(w, r, err)
 	return
    }
 
-   err = app.models.User.DeleteById(requestPaylaod.ID)
+   // keep what the user looked like for the audit log
+   before, _ := app.models.User.GetOne(r.Context(), requestPaylaod.ID)
+
+   err = app.models.User.DeleteById(r.Context(), requestPaylaod.ID)
    if err != nil{
-	app.errorJSON(w, err)
+	app.errorJSON(w, r, err)
 	return
    }
 
+   app.audit(r, "user.delete", "user", requestPaylaod.ID, before, nil)
+
    payload := jsonResponse{
 	Error: false,
 	Message: "User deleted",
@@ -244,52 +363,54 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request){
 func (app *application) LogUserOutAndSetInactive(w http.ResponseWriter, r *http.Request){
 	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
-	user, err := app.models.User.GetOne(userID)
+	user, err := app.models.User.GetOne(r.Context(), userID)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
+	before := *user
+
 	user.Active = 0
-	err = user.Update()
+	err = user.Update(r.Context())
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
 	// delete tokens for user
-	err =  app.models.Token.DeleteTokensForuser(userID)
+	err =  app.models.Token.DeleteTokensForuser(r.Context(), userID)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
+	app.audit(r, "user.logout", "user", userID, before, user)
+
 	payload := jsonResponse{
 		Error: false,
 		Message: "user logged out and set to inactive",
 	}
 
-	_ = app.writeJSON(w, http.StatusAccepted, payload)
+	_ = app.writeJSON(w, doneStatus(r), payload)
 
 }
 
 func (app *application) ValidateToken(w http.ResponseWriter, r *http.Request){
-    var requestPaylaod struct {
-		Token string `json:"token"`
-	}
+    var requestPaylaod tokenRequest
 
 	err := app.readJSON(w, r, &requestPaylaod)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
     
-	valid := false
-	valid, _ = app.models.Token.ValidToken(requestPaylaod.Token)
+	valid, err := app.models.Token.ValidToken(r.Context(), requestPaylaod.Token)
+	recordTokenValidation(err)
 	
 	payload := jsonResponse {
 		Error: false,
@@ -300,9 +421,24 @@ func (app *application) ValidateToken(w http.ResponseWriter, r *http.Request){
 }
 
 func (app *application) AllBooks(w http.ResponseWriter, r *http.Request) {
-	books, err := app.models.Book.GetAll()
+	format := negotiateFormat(r, listFormats...)
+
+	headers, fresh := app.catalogCache(w, r, format)
+	if fresh {
+		return
+	}
+
+	books, err := app.models.Book.GetAll(r.Context())
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	app.withCoverURLs(books...)
+
+	// analysts pull the catalog into spreadsheets, see listFormats
+	if format != formatJSON {
+		_ = writeList(w, http.StatusOK, format, "books", books, bookCSVColumns, headers)
 		return
 	}
 
@@ -312,36 +448,38 @@ func (app *application) AllBooks(w http.ResponseWriter, r *http.Request) {
 		Data: envelope{"books": books},
 	}
 
-	app.writeJSON(w, http.StatusOK, payload)
+	app.writeJSON(w, http.StatusOK, payload, headers)
 }
 
 func (app *application) OneBook(w http.ResponseWriter, r *http.Request) {
 	slug := chi.URLParam(r, "slug")
 
-	book, err := app.models.Book.GetOneBySlug(slug)
+	headers, fresh := app.catalogCache(w, r, formatJSON)
+	if fresh {
+		return
+	}
+
+	book, err := app.models.Book.GetOneBySlug(r.Context(), slug)
 	if err != nil{
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
+	app.withCoverURLs(book)
+
 	payload := jsonResponse {
 		Error: false,
 		Data: book,
 	}
-	app.writeJSON(w, http.StatusOK, payload)
+	app.writeJSON(w, http.StatusOK, payload, headers)
 } 
 func (app *application) AuthorsAll(w http.ResponseWriter, r *http.Request) {
-	all, err := app.models.Author.All()
+	all, err := app.models.Author.All(r.Context())
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
-	type selectData struct {
-		Value int `json:"value"`
-		Text string `json:"text"`
-	}
-
 	var results []selectData
 
 	for _, x := range all {
@@ -362,19 +500,11 @@ func (app *application) AuthorsAll(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) EditBook(w http.ResponseWriter, r *http.Request) {
-	var requestPaylaod struct{
-		ID int `json:"id"`
-		Title string `json:"title"`
-		AuthorID int `json:"author_id"`
-		PublicationYear int `json:"publication_year"`
-		Description string `json:"description"`
-		CoverBase64 string `json:"cover"`
-		GenreIDs []int `json:"genre_ids"`
-	}
+	var requestPaylaod bookRequest
 
 	err := app.readJSON(w, r, &requestPaylaod)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
@@ -386,36 +516,87 @@ func (app *application) EditBook(w http.ResponseWriter, r *http.Request) {
 		Description: requestPaylaod.Description,
 		Slug: slugify.Slugify(requestPaylaod.Title),
 		GenreIDs: requestPaylaod.GenreIDs,
+		GenresSet: requestPaylaod.GenreIDs != nil, // leaving genre_ids out keeps the genres, [] clears them
 	}
 
+	// when editing, keep what the book looked like for the audit log, and
+	// make sure nobody else saved it since the client loaded it
+	var before *data.Book
+	if book.ID != 0 {
+		before, err = app.models.Book.GetOneById(r.Context(), book.ID)
+		if err != nil {
+			app.errorJSON(w, r, err)
+			return
+		}
+
+		if !app.checkIfMatch(w, r, before, before.Version) {
+			return
+		}
+		book.Version = before.Version
+	}
+
+	if before == nil || book.AuthorID != before.AuthorID {
+		v := validator.New()
+		app.checkAuthor(r.Context(), v, book.AuthorID)
+		if err := v.Err(); err != nil {
+			app.errorJSON(w, r, err)
+			return
+		}
+	}
+
+	var coverHash string
 	if len(requestPaylaod.CoverBase64) > 0 {
 		// it means we have a cover
 
 		decoded, err := base64.StdEncoding.DecodeString(requestPaylaod.CoverBase64)
 		if err != nil {
-			app.errorJSON(w, err)
+			app.errorJSON(w, r, err)
 			return
 		}
-		if err := os.WriteFile(fmt.Sprintf("%s/covers/%s.jpg", staticPath, book.Slug), decoded, 0666);
-		 err != nil{
-			app.errorJSON(w, err)
+		coverUploadBytes.Observe(float64(len(decoded)))
+		// the cover is stored before the book, so a book never points at a cover that isn't there
+		coverHash, err = app.storeCover(r.Context(), bytes.NewReader(decoded))
+		if err != nil{
+			app.coverError(w, r, err)
 			return	
 		}
+	}
 
-		if book.ID == 0 {
-			// adding a book
-			_, err := app.models.Book.Insert(book)
-			if err != nil {
-				app.errorJSON(w, err)
-				return
-			}
-		}else {
-			// update a book
-			err := book.Update()
-			if err != nil {
-				app.errorJSON(w, err)
-				return
+	// the cover is optional, but the book itself is always saved
+	if book.ID == 0 {
+		// adding a book
+		id, err := app.models.Book.Insert(r.Context(), book)
+		if err != nil {
+			app.errorJSON(w, r, err)
+			return
+		}
+		book.ID = id
+
+		after, _ := app.models.Book.GetOneById(r.Context(), id)
+		app.audit(r, "book.create", "book", id, nil, after)
+	}else {
+		// update a book
+		err = book.Update(r.Context())
+		if err != nil {
+			if errors.Is(err, data.ErrEditConflict) {
+				// someone saved in between us reading and writing
+				if latest, err := app.models.Book.GetOneById(r.Context(), book.ID); err == nil {
+					app.preconditionFailed(w, r, latest, latest.Version)
+					return
+				}
 			}
+			app.errorJSON(w, r, err)
+			return
+		}
+
+		after, _ := app.models.Book.GetOneById(r.Context(), book.ID)
+		app.audit(r, "book.update", "book", book.ID, before, after)
+	}
+
+	if coverHash != "" {
+		if _, err := app.models.Book.SetCover(r.Context(), book.ID, coverHash); err != nil {
+			app.errorJSON(w, r, err)
+			return
 		}
 	}
 
@@ -424,47 +605,56 @@ func (app *application) EditBook(w http.ResponseWriter, r *http.Request) {
 		Message: "Changes saved",
 	}
 
-	app.writeJSON(w, http.StatusAccepted, payload)
+	app.writeJSON(w, savedStatus(r, requestPaylaod.ID == 0), payload)
 }
 
 func(app *application) BookByID(w http.ResponseWriter, r *http.Request) {
 	bookID, err := strconv.Atoi(chi.URLParam(r, "id")) // we will look for the id and convert it
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
-	book, err := app.models.Book.GetOneById(bookID)
+	book, err := app.models.Book.GetOneById(r.Context(), bookID)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
+	app.withCoverURLs(book)
+
 	payload := jsonResponse {
 		Error: false,
 		Data: book,
 	}
 
-	app.writeJSON(w, http.StatusAccepted, payload)
+	// the ETag has to be sent back in If-Match when saving the book
+	headers := make(http.Header)
+	headers.Set("ETag", etag(book.Version))
+
+	app.writeJSON(w, doneStatus(r), payload, headers)
 }
 
 func (app *application) DeleteBook (w http.ResponseWriter, r *http.Request) {
-	var requestPaylaod struct {
-		ID int `json:"id"`
-	}
+	var requestPaylaod idRequest
 
 	err := app.readJSON(w, r, &requestPaylaod)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
-	err = app.models.Book.DeleteByID(requestPaylaod.ID)
+	// keep what the book looked like for the audit log
+	before, _ := app.models.Book.GetOneById(r.Context(), requestPaylaod.ID)
+
+	err = app.models.Book.DeleteByID(r.Context(), requestPaylaod.ID)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.errorJSON(w, r, err)
 		return
 	}
 
+	app.audit(r, "book.delete", "book", requestPaylaod.ID, before, nil)
+
 	payload := jsonResponse {
 		Error: false,
 		Message: "Book Deleted",
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"Bookstore-Backend/internal/validator"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
 )
 
 func TestApplication_AllUsers(t *testing.T) {
@@ -27,4 +34,81 @@ func TestApplication_AllUsers(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Error("AllUsers returned wrong status code of", rr.Code)
 	}
-}
\ No newline at end of file
+}
+func TestApplication_EditBook_Validation(t *testing.T) {
+	nextYear := strconv.Itoa(time.Now().Year() + 1)
+
+	var tests = []struct {
+		name           string
+		body           string
+		checksAuthor   bool
+		authorExists   bool
+		expectedCode   int
+		expectedFields []string
+	}{
+		{"every problem at once", `{"title": " ", "author_id": -1, "publication_year": ` + nextYear + `}`, false, false, http.StatusUnprocessableEntity, []string{"title", "author_id", "publication_year"}},
+		{"unknown field", `{"title": "It", "author_id": 1, "publication_year": 1986, "slug": "it"}`, false, false, http.StatusBadRequest, nil},
+		{"no such author", `{"title": "It", "author_id": 99, "publication_year": 1986}`, true, false, http.StatusUnprocessableEntity, []string{"author_id"}},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			if e.checksAuthor {
+				mock.ExpectQuery("select exists").WithArgs(99).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(e.authorExists))
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/admin/books/save", strings.NewReader(e.body))
+			http.HandlerFunc(testApp.EditBook).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Fatalf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+
+			var resp struct {
+				Code string `json:"code"`
+				Data struct {
+					Errors validator.Errors `json:"errors"`
+				} `json:"data"`
+			}
+			_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+
+			var fields []string
+			for _, f := range resp.Data.Errors {
+				fields = append(fields, f.Field)
+			}
+			if !reflect.DeepEqual(fields, e.expectedFields) {
+				t.Errorf("expected errors for %v but got %v", e.expectedFields, fields)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestApplication_EditUser_NewWithoutPassword(t *testing.T) {
+	newMockDB(t)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/users/save", strings.NewReader(`{"email": "me@here.com", "active": 1}`))
+	http.HandlerFunc(testApp.EditUser).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Data struct {
+			Errors validator.Errors `json:"errors"`
+		} `json:"data"`
+	}
+	_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if len(resp.Data.Errors) != 1 || resp.Data.Errors[0].Field != "password" {
+		t.Errorf("expected an error for the password only, got %s", rr.Body.String())
+	}
+}
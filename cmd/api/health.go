@@ -0,0 +1,187 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessTimeout is how long a single readiness check may take
+	readinessTimeout = 2 * time.Second
+
+	// readinessProbeKey is written to, and removed from, the cover store to check we can write to it
+	readinessProbeKey = "health/readyz"
+
+	// storeProbeTTL is how long the result of probing the cover store is reused for. The
+	// orchestrator asks every few seconds, and every probe is a write and a delete.
+	storeProbeTTL = 5 * time.Second
+)
+
+// check is the result of one readiness check. Anyone can ask for it, so why a check
+// failed is only logged.
+type check struct {
+	Status string `json:"status"`
+}
+
+// Healthz tells the orchestrator the process is alive. It checks nothing else, so a
+// database outage doesn't get every instance restarted.
+func (app *application) Healthz(w http.ResponseWriter, r *http.Request) {
+	payload := jsonResponse{
+		Error:   false,
+		Message: "ok",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// Readyz tells the orchestrator whether we can serve traffic: the database is reachable
+// and migrated, and covers can be stored. While shutting down we always say no, so
+// traffic is moved away before the server stops.
+func (app *application) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := app.readinessChecks(r.Context())
+
+	ready := true
+	for _, c := range checks {
+		if c.Status != "ok" {
+			ready = false
+		}
+	}
+
+	payload := jsonResponse{
+		Error:   !ready,
+		Message: "ready",
+		Data:    envelope{"checks": checks},
+	}
+
+	if app.shuttingDown() {
+		ready = false
+		payload.Error = true
+		payload.Message = "shutting down"
+	} else if !ready {
+		payload.Message = "not ready"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	_ = app.writeJSON(w, status, payload, http.Header{"Cache-Control": {"no-store"}})
+}
+
+// readinessChecks runs every readiness check at once, each with its own timeout
+func (app *application) readinessChecks(ctx context.Context) map[string]check {
+	probes := map[string]func(context.Context) error{
+		"database":   data.Ping,
+		"migrations": checkMigrations,
+		"store":      app.checkStore,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	checks := make(map[string]check, len(probes))
+
+	for name, probe := range probes {
+		wg.Add(1)
+		go func(name string, probe func(context.Context) error) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := probe(ctx)
+
+			c := check{Status: "ok"}
+			if err != nil {
+				c.Status = "failed"
+				app.logger.WarnContext(ctx, "readiness check failed", "check", name, "error", err,
+					"duration_ms", time.Since(start).Milliseconds())
+			}
+
+			mu.Lock()
+			checks[name] = c
+			mu.Unlock()
+		}(name, probe)
+	}
+
+	wg.Wait()
+
+	return checks
+}
+
+// checkMigrations makes sure the database has every migration this code relies on
+func checkMigrations(ctx context.Context) error {
+	version, dirty, err := data.MigrationVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migration %d failed and needs fixing", version)
+	}
+	if version < data.SchemaVersion {
+		return fmt.Errorf("database is at migration %d, but %d is needed", version, data.SchemaVersion)
+	}
+
+	return nil
+}
+
+// checkStore makes sure covers can be written, by writing and removing a small blob.
+// Answering reads isn't enough: a read-only mount, a full disk or credentials which
+// can't put objects all still do that.
+func (app *application) checkStore(ctx context.Context) error {
+	probe := func(ctx context.Context) error {
+		const body = "ok"
+
+		err := app.store.Put(ctx, readinessProbeKey, strings.NewReader(body), int64(len(body)), "text/plain")
+		if err != nil {
+			return err
+		}
+
+		return app.store.Delete(ctx, readinessProbeKey)
+	}
+
+	if app.storeProbe == nil {
+		return probe(ctx)
+	}
+	return app.storeProbe.run(ctx, storeProbeTTL, probe)
+}
+
+// probeCache remembers the result of a readiness check for a while, so a check which
+// costs something isn't run on every request
+type probeCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// run returns the result of the last run of probe if it is younger than ttl, and runs it
+// again otherwise. Callers arriving while it runs wait for its result.
+func (c *probeCache) run(ctx context.Context, ttl time.Duration, probe func(context.Context) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checked.IsZero() && time.Since(c.checked) < ttl {
+		return c.err
+	}
+
+	c.err = probe(ctx)
+	c.checked = time.Now()
+
+	return c.err
+}
+
+// shuttingDown reports whether the server has started shutting down
+func (app *application) shuttingDown() bool {
+	select {
+	case <-app.shutdown:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestApplication_Healthz(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	http.HandlerFunc(testApp.Healthz).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Error("Healthz returned wrong status code of", rr.Code)
+	}
+}
+
+func TestApplication_Readyz(t *testing.T) {
+	var tests = []struct {
+		name     string
+		version  int
+		dirty    bool
+		dbErr    error
+		shutdown bool
+		status   int
+		failed   string
+	}{
+		{"ready", data.SchemaVersion, false, nil, false, http.StatusOK, ""},
+		{"newer schema", data.SchemaVersion + 1, false, nil, false, http.StatusOK, ""},
+		{"behind", data.SchemaVersion - 1, false, nil, false, http.StatusServiceUnavailable, "migrations"},
+		{"dirty", data.SchemaVersion, true, nil, false, http.StatusServiceUnavailable, "migrations"},
+		{"database down", 0, false, errors.New("connection refused"), false, http.StatusServiceUnavailable, "migrations"},
+		{"shutting down", data.SchemaVersion, false, nil, true, http.StatusServiceUnavailable, ""},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			dir := useTempStaticPath(t)
+			mock := newMockDB(t)
+
+			query := mock.ExpectQuery("select version, dirty from schema_migrations")
+			if e.dbErr != nil {
+				query.WillReturnError(e.dbErr)
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(e.version, e.dirty))
+			}
+
+			app := testApp
+			app.shutdown = make(chan struct{})
+			if e.shutdown {
+				close(app.shutdown)
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/readyz", nil)
+			http.HandlerFunc(app.Readyz).ServeHTTP(rr, req)
+
+			if rr.Code != e.status {
+				t.Fatalf("expected %d but got %d: %s", e.status, rr.Code, rr.Body.String())
+			}
+
+			var payload struct {
+				Data struct {
+					Checks map[string]check `json:"checks"`
+				} `json:"data"`
+			}
+			_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+			for _, name := range []string{"database", "migrations", "store"} {
+				c, ok := payload.Data.Checks[name]
+				if !ok {
+					t.Errorf("%s check missing", name)
+					continue
+				}
+				if (c.Status != "ok") != (name == e.failed) {
+					t.Errorf("%s check is %q", name, c.Status)
+				}
+			}
+
+			// the probe is removed again
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(readinessProbeKey))); !os.IsNotExist(err) {
+				t.Error("readiness probe left in the store")
+			}
+		})
+	}
+}
+
+// readOnlyStore answers everything but refuses writes, like a read-only mount or
+// credentials without PutObject
+type readOnlyStore struct {
+	storage.BlobStore
+}
+
+func (readOnlyStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	return errors.New("read-only file system")
+}
+
+func TestApplication_Readyz_StoreFails(t *testing.T) {
+	var tests = []struct {
+		name  string
+		setup func(t *testing.T, dir string)
+	}{
+		{"broken", func(t *testing.T, dir string) {
+			// a file where the probe's directory should be
+			if err := os.WriteFile(filepath.Join(dir, "health"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"read only", func(t *testing.T, dir string) {
+			testApp.store = readOnlyStore{testApp.store}
+		}},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			dir := useTempStaticPath(t)
+			mock := newMockDB(t)
+			mock.ExpectQuery("select version, dirty from schema_migrations").
+				WillReturnRows(sqlmock.NewRows([]string{"version", "dirty"}).AddRow(data.SchemaVersion, false))
+
+			e.setup(t, dir)
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/readyz", nil)
+			http.HandlerFunc(testApp.Readyz).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Error("expected 503 but got", rr.Code, rr.Body.String())
+			}
+
+			// why it failed is logged, but never sent to whoever asked
+			var payload struct {
+				Data struct {
+					Checks map[string]map[string]interface{} `json:"checks"`
+				} `json:"data"`
+			}
+			_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+			expected := map[string]interface{}{"status": "failed"}
+			if got := payload.Data.Checks["store"]; !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected the store check to be %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func Test_probeCache(t *testing.T) {
+	var c probeCache
+	runs := 0
+	probe := func(context.Context) error {
+		runs++
+		return errors.New("read-only file system")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.run(context.Background(), time.Hour, probe); err == nil {
+			t.Error("expected the cached failure")
+		}
+	}
+	if runs != 1 {
+		t.Errorf("expected the probe to run once, ran %d times", runs)
+	}
+
+	c.checked = time.Now().Add(-2 * time.Hour)
+	_ = c.run(context.Background(), time.Hour, probe)
+	if runs != 2 {
+		t.Error("expected the probe to run again once the result is stale")
+	}
+}
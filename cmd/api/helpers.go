@@ -1,13 +1,20 @@
 package main
 
 import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/validator"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// readJSON decodes the json body of r into data, and validates it. Bodies with fields
+// data doesn't have are rejected, so typos don't go unnoticed. Problems with the values
+// are returned as validator.Errors.
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data interface{}) error{
     
 	maxBytes := 1048576 //  max file size will accept as post. It means 1 mb
@@ -15,10 +22,11 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data in
 
 
 	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
 	err := dec.Decode(data)
 
 	if err != nil{
-		return nil
+		return decodeError(err, maxBytes)
 	}
 	 
 	err = dec.Decode(&struct{}{}) // to be make sure body has single json value
@@ -27,7 +35,35 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, data in
 		return errors.New("body must have only a single json value")
 	}
 
-	return nil
+	return validator.Validate(data)
+}
+
+// decodeError turns an error from decoding a json body into one a client can act on
+func decodeError(err error, maxBytes int) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("body contains badly formed json (at character %d)", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly formed json")
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Errorf("body contains the wrong json type for field %q", typeErr.Field)
+		}
+		return fmt.Errorf("body contains the wrong json type (at character %d)", typeErr.Offset)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for this
+		return fmt.Errorf("body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	case errors.As(err, &maxBytesErr):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	default:
+		return err
+	}
 }
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header ) error{
@@ -58,7 +94,9 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 	_, err := w.Write(output)
 	if err != nil {
@@ -68,34 +106,152 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data interf
 	return nil
 }
 
-func(app *application) errorJSON(w http.ResponseWriter, err error, status ...int) error{
+// errorJSON writes an error response, as a jsonResponse or, when the client asks for it,
+// as problem details. Errors from the data package decide the status themselves; status
+// is used for any other error, and is 400 when not given. Messages of server errors are
+// not sent to clients, since they can hold driver or system details.
+func(app *application) errorJSON(w http.ResponseWriter, r *http.Request, err error, status ...int) error{
 	statusCode := http.StatusBadRequest
 
 	if len(status) > 0 {
 		statusCode = status[0]
 	}
 
-	var customErr error
+	message := err.Error()
+	code := ""
+	var fields validator.Errors
 
-	switch{
-	case strings.Contains(err.Error(), "SQLSTATE 23505"): // Postgres error
-	customErr = errors.New("duplicate value violates unique constraints")
-	statusCode = http.StatusForbidden
-	case strings.Contains(err.Error(), "SQLSTATE 22001"):
-		customErr = errors.New("too large value")
-		statusCode = http.StatusForbidden
-	case strings.Contains(err.Error(), "SQLSTATE 23403"):
-		customErr = errors.New("Foreign key violation")
-		statusCode = http.StatusForbidden
-	default:
-		customErr = err
-		
+	var dataErr *data.Error
+	switch {
+	case errors.As(err, &dataErr):
+		statusCode = kindStatus[dataErr.Kind]
+		message = dataErr.Message
+		code = dataErr.Code
+		if dataErr.Field != "" {
+			fields = validator.Errors{{Field: dataErr.Field, Code: dataErr.Code, Message: dataErr.Message}}
+		}
+	case errors.As(err, &fields):
+		statusCode = http.StatusUnprocessableEntity
+		message = "the request has invalid fields"
+		code = "validation_failed"
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		app.logger.ErrorContext(r.Context(), "server error", "error", err)
+		if dataErr == nil {
+			message = "internal server error"
+		}
+	}
+
+	if code == "" {
+		code = statusErrorCode(statusCode)
+	}
+
+	// the format of the response depends on Accept
+	w.Header().Add("Vary", "Accept")
+
+	if wantsProblem(r) {
+		app.writeProblem(w, r, problem{Status: statusCode, Code: code, Detail: message, Errors: fields})
+		return nil
 	}
 
 	var payload jsonResponse
 	payload.Error = true
-	payload.Message = customErr.Error()
+	payload.Message = message
+	payload.Code = code
+	if len(fields) > 0 {
+		payload.Data = envelope{"errors": fields}
+	}
 
 	app.writeJSON(w, statusCode, payload)
 	return nil
-}
\ No newline at end of file
+}
+
+// kindStatus is the response status for each kind of error from the data package
+var kindStatus = map[data.Kind]int{
+	data.ErrNotFound:     http.StatusNotFound,
+	data.ErrConflict:     http.StatusConflict,
+	data.ErrValidation:   http.StatusUnprocessableEntity,
+	data.ErrUnauthorized: http.StatusUnauthorized,
+	data.ErrForbidden:    http.StatusForbidden,
+	data.ErrInternal:     http.StatusInternalServerError,
+}
+
+// statusErrorCode is the error code for errors which don't have one of their own, made from
+// the status, like "not_found" for 404
+func statusErrorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// errPreconditionRequired is returned by ifMatchVersion when the client didn't send If-Match
+var errPreconditionRequired = errors.New("this request must include an If-Match header with the ETag of the record being edited")
+
+// etag returns the entity tag for one version of a record
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// ifMatchVersion returns the version of the record the client is editing, taken from the
+// If-Match header. "*" matches whatever the current version is, and is returned as current.
+func ifMatchVersion(r *http.Request, current int) (int, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		return 0, errPreconditionRequired
+	}
+
+	if ifMatch == "*" {
+		return current, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`))
+	if err != nil {
+		return 0, errors.New("invalid If-Match header")
+	}
+
+	return version, nil
+}
+
+// preconditionFailed tells the client that it tried to save a stale copy of a record,
+// and sends back the current one so it can merge and try again
+func (app *application) preconditionFailed(w http.ResponseWriter, r *http.Request, current interface{}, version int) {
+	const message = "this record was changed by someone else, reload it and try again"
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(version))
+	headers.Set("Vary", "Accept")
+
+	if wantsProblem(r) {
+		app.writeProblem(w, r, problem{Status: http.StatusPreconditionFailed, Code: data.ErrEditConflict.Code, Detail: message, Data: current}, headers)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   true,
+		Message: message,
+		Code:    data.ErrEditConflict.Code,
+		Data:    current,
+	}
+
+	_ = app.writeJSON(w, http.StatusPreconditionFailed, payload, headers)
+}
+
+// checkIfMatch makes sure the client is editing the current version of a record. If it
+// isn't, the response has already been written and false is returned.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, current interface{}, currentVersion int) bool {
+	version, err := ifMatchVersion(r, currentVersion)
+	if err != nil {
+		if errors.Is(err, errPreconditionRequired) {
+			app.errorJSON(w, r, err, http.StatusPreconditionRequired)
+			return false
+		}
+		app.errorJSON(w, r, err)
+		return false
+	}
+
+	if version != currentVersion {
+		app.preconditionFailed(w, r, current, currentVersion)
+		return false
+	}
+
+	return true
+}
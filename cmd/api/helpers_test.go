@@ -1,12 +1,20 @@
 package main
 
 import (
+	"Bookstore-Backend/internal/logging"
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/jackc/pgconn"
 )
 
 func Test_readJSON(t *testing.T){
@@ -67,7 +75,8 @@ func Test_writeJSON(t *testing.T) {
 
 func Test_errorJSON(t *testing.T) {
 	rr := httptest.NewRecorder()
-	err := testApp.errorJSON(rr, errors.New("some error"))
+	req, _ := http.NewRequest("GET", "/", nil)
+	err := testApp.errorJSON(rr, req, errors.New("some error"))
 	if err != nil {
 		t.Error(err)
 	}
@@ -81,7 +90,7 @@ func Test_errorJSON(t *testing.T) {
 	}
 
 	for _, x := range errSlice{
-		customErr := testApp.errorJSON(rr, errors.New(x), http.StatusUnauthorized)
+		customErr := testApp.errorJSON(rr, req, errors.New(x), http.StatusUnauthorized)
 		if customErr != nil {
 			t.Error(customErr)
 		}
@@ -89,6 +98,76 @@ func Test_errorJSON(t *testing.T) {
 	}
 }
 
+func Test_errorJSON_DataErrors(t *testing.T) {
+	var tests = []struct {
+		name   string
+		dbErr  error
+		status int
+		code   string
+	}{
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, "not_found"},
+		{"unique", &pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint \"users_email_key\""}, http.StatusConflict, "duplicate"},
+		{"foreign key", &pgconn.PgError{Code: "23503", Message: "insert or update on table \"books\" violates foreign key constraint"}, http.StatusConflict, "foreign_key_violation"},
+		{"too long", &pgconn.PgError{Code: "22001", Message: "value too long for type character varying(255)"}, http.StatusUnprocessableEntity, "value_too_large"},
+		{"unknown", &pgconn.PgError{Code: "XX000", Message: "internal_error in relation \"tokens\""}, http.StatusInternalServerError, "internal_error"},
+		{"connection", errors.New("dial tcp 10.0.0.1:5432: connection refused"), http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			mock.ExpectExec("delete from tokens where token = \\$1").WillReturnError(e.dbErr)
+
+			err := testApp.models.Token.DeleteByToken(context.Background(), "token")
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			_ = testApp.errorJSON(rr, req, err, http.StatusBadRequest)
+
+			if rr.Code != e.status {
+				t.Errorf("expected %d but got %d", e.status, rr.Code)
+			}
+
+			var payload jsonResponse
+			_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+			if payload.Code != e.code {
+				t.Errorf("expected code %q but got %q", e.code, payload.Code)
+			}
+
+			// nothing from the driver reaches the client
+			if strings.Contains(payload.Message, "relation") || strings.Contains(payload.Message, "10.0.0.1") || strings.Contains(payload.Message, "constraint \"") {
+				t.Errorf("driver message leaked: %s", payload.Message)
+			}
+		})
+	}
+}
+
+func Test_errorJSON_ServerError(t *testing.T) {
+	var buf bytes.Buffer
+	app := testApp
+	app.logger = logging.New(&buf, slog.LevelInfo)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = req.WithContext(logging.WithRequestID(req.Context(), "req-1"))
+	_ = app.errorJSON(rr, req, errors.New("open /var/lib/covers: permission denied"), http.StatusInternalServerError)
+
+	var payload jsonResponse
+	_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+	if payload.Message != "internal server error" || payload.Code != "internal_server_error" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+
+	// the details are logged instead, with the request they belong to
+	var entry map[string]any
+	_ = json.Unmarshal(buf.Bytes(), &entry)
+	if entry["request_id"] != "req-1" || !strings.Contains(fmt.Sprint(entry["error"]), "permission denied") {
+		t.Errorf("unexpected log %s", buf.String())
+	}
+}
+
 func testJSONPayload(t *testing.T, rr *httptest.ResponseRecorder) {
 	var requestPayload jsonResponse
 	decoder := json.NewDecoder(rr.Body)
@@ -100,4 +179,32 @@ func testJSONPayload(t *testing.T, rr *httptest.ResponseRecorder) {
 	if !requestPayload.Error {
 		t.Error("error set to false in response from errorJSON, and it should be st to true")
 	}
-}
\ No newline at end of file
+}
+func Test_readJSON_Errors(t *testing.T) {
+	var tests = []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"empty", ``, "body must not be empty"},
+		{"badly formed", `{"title": }`, "badly formed json"},
+		{"wrong type", `{"title": 5}`, `wrong json type for field "title"`},
+		{"unknown field", `{"title": "It", "slug": "it"}`, `unknown field "slug"`},
+		{"two values", `{"title": "It"} {}`, "single json value"},
+		{"invalid", `{"title": " "}`, "title must be given"},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			var dst struct {
+				Title string `json:"title" validate:"required"`
+			}
+
+			req, _ := http.NewRequest("POST", "/", strings.NewReader(e.body))
+			err := testApp.readJSON(httptest.NewRecorder(), req, &dst)
+			if err == nil || !strings.Contains(err.Error(), e.expected) {
+				t.Errorf("expected an error containing %q but got %v", e.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	idempotencyPurgeInterval = time.Hour
+
+	// maxIdempotentBody is the largest body a request with an Idempotency-Key can have,
+	// since it is read up front to tell retries from different requests. It leaves room
+	// for a cover upload.
+	maxIdempotentBody = 16 << 20
+)
+
+// idempotencyKeyPattern is what we accept as an Idempotency-Key: visible ascii, like a uuid
+var idempotencyKeyPattern = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+var errInvalidIdempotencyKey = errors.New("Idempotency-Key must be 1 to 255 visible ascii characters")
+
+// Idempotency makes requests sent with an Idempotency-Key header safe to retry. The
+// response to the first request with a key is saved, and sent again for every retry
+// until app.config.idempotencyRetention has passed, without the request being handled
+// again. Reusing a key for a different request is an error, and so is retrying while
+// the first request is still being handled. Responses are saved per user, so this only
+// works on routes which need a token; elsewhere the header is ignored. Server errors
+// aren't saved, so those requests can be retried for real.
+func (app *application) Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		user := app.contextGetUser(r)
+		if key == "" || user == nil || !mutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !idempotencyKeyPattern.MatchString(key) {
+			app.errorJSON(w, r, errInvalidIdempotencyKey)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				app.errorJSON(w, r, decodeError(err, maxIdempotentBody), http.StatusRequestEntityTooLarge)
+				return
+			}
+			app.errorJSON(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		expires := time.Now().Add(app.config.idempotencyRetention)
+		saved, err := app.models.IdempotencyKey.Begin(r.Context(), user.ID, key, requestHash(r, body), expires)
+		if err != nil {
+			if errors.Is(err, data.ErrIdempotencyKeyInProcess) {
+				w.Header().Set("Retry-After", "1")
+			}
+			app.errorJSON(w, r, err)
+			return
+		}
+
+		if saved != nil {
+			for name, values := range saved.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.Status)
+			_, _ = w.Write(saved.Body)
+			return
+		}
+
+		completed := false
+		defer func() {
+			// the key is given up on server errors and panics, so the client can try again
+			if !completed {
+				if err := app.models.IdempotencyKey.Release(context.WithoutCancel(r.Context()), user.ID, key); err != nil {
+					app.logger.ErrorContext(r.Context(), "cannot release idempotency key", "error", err)
+				}
+			}
+		}()
+
+		before := w.Header().Clone()
+		sw := &snapshotWriter{ResponseWriter: w}
+		var response bytes.Buffer
+		ww := middleware.NewWrapResponseWriter(sw, r.ProtoMajor)
+		ww.Tee(&response)
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= http.StatusInternalServerError {
+			return
+		}
+
+		err = app.models.IdempotencyKey.Complete(context.WithoutCancel(r.Context()), user.ID, key, status, handlerHeaders(before, sw.headers()), response.Bytes())
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "cannot save idempotent response", "error", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// mutating reports whether requests with method change anything
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// requestHash identifies a request, so a retry can be told apart from a different
+// request sent with the same key
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// handlerHeaders returns the headers which were set after before was taken, which are
+// the ones the handler set. The rest, like the request id, belong to each response.
+func handlerHeaders(before, after http.Header) http.Header {
+	h := make(http.Header)
+	for name, values := range after {
+		if !reflect.DeepEqual(before[name], values) {
+			h[name] = values
+		}
+	}
+	return h
+}
+
+// snapshotWriter keeps the headers as they were when the handler started its response.
+// Middleware further out, like Compress, changes them after that for the representation
+// it sends, which differs from one retry to the next, and mustn't be saved with the body
+// the handler wrote.
+type snapshotWriter struct {
+	http.ResponseWriter
+	header http.Header
+}
+
+func (sw *snapshotWriter) WriteHeader(status int) {
+	if sw.header == nil {
+		sw.header = sw.Header().Clone()
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *snapshotWriter) Write(b []byte) (int, error) {
+	if sw.header == nil {
+		sw.header = sw.Header().Clone()
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *snapshotWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *snapshotWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// headers returns the headers the handler responded with
+func (sw *snapshotWriter) headers() http.Header {
+	if sw.header == nil {
+		return sw.Header() // nothing was written
+	}
+	return sw.header
+}
+
+// purgeIdempotencyKeys deletes expired idempotency keys every interval, until the
+// application exits
+func (app *application) purgeIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.models.IdempotencyKey.PurgeExpired(context.Background())
+		if err != nil {
+			app.logger.Error("cannot purge idempotency keys", "error", err)
+			continue
+		}
+		if n > 0 {
+			app.logger.Info("purged idempotency keys", "keys", n)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var idempotencyColumns = []string{"id", "user_id", "key", "request_hash", "status", "headers", "body", "created_at", "expires_at"}
+
+func TestApplication_Idempotency(t *testing.T) {
+	const body = `{"title": "It"}`
+
+	req, _ := http.NewRequest("POST", "/admin/books/save", strings.NewReader(body))
+	hash := requestHash(req, []byte(body))
+
+	var tests = []struct {
+		name         string
+		expect       func(mock sqlmock.Sqlmock)
+		handled      bool
+		expectedCode int
+		expectedBody string
+		replayed     bool
+	}{
+		{"first request", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("insert into idempotency_keys").WithArgs(1, "abc", hash, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			mock.ExpectExec("update idempotency_keys set status").
+				WithArgs(http.StatusAccepted, []byte(`{"Content-Type":["application/json"],"Etag":["\"1\""]}`), []byte(`{"saved":1}`), 1, "abc").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}, true, http.StatusAccepted, `{"saved":1}`, false},
+		{"retry", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("insert into idempotency_keys").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectQuery("select (.+) from idempotency_keys").WithArgs(1, "abc").
+				WillReturnRows(sqlmock.NewRows(idempotencyColumns).
+					AddRow(1, 1, "abc", hash, http.StatusAccepted, []byte(`{"Content-Type":["application/json"]}`), []byte(`{"saved":1}`), time.Now(), time.Now().Add(time.Hour)))
+		}, false, http.StatusAccepted, `{"saved":1}`, true},
+		{"different request", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("insert into idempotency_keys").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectQuery("select (.+) from idempotency_keys").
+				WillReturnRows(sqlmock.NewRows(idempotencyColumns).
+					AddRow(1, 1, "abc", "another hash", http.StatusAccepted, nil, nil, time.Now(), time.Now().Add(time.Hour)))
+		}, false, http.StatusUnprocessableEntity, "", false},
+		{"still in progress", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("insert into idempotency_keys").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectQuery("select (.+) from idempotency_keys").
+				WillReturnRows(sqlmock.NewRows(idempotencyColumns).
+					AddRow(1, 1, "abc", hash, nil, nil, nil, time.Now(), time.Now().Add(time.Hour)))
+		}, false, http.StatusConflict, "", false},
+		{"server error", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("insert into idempotency_keys").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			mock.ExpectExec("delete from idempotency_keys").WithArgs(1, "abc").WillReturnResult(sqlmock.NewResult(0, 1))
+		}, true, http.StatusInternalServerError, "", false},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			e.expect(mock)
+
+			handled := false
+			handler := testApp.Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handled = true
+				if e.expectedCode == http.StatusInternalServerError {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", `"1"`)
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte(`{"saved":1}`))
+			}))
+
+			rr := httptest.NewRecorder()
+			rr.Header().Set("X-Request-ID", "set by earlier middleware")
+			req, _ := http.NewRequest("POST", "/admin/books/save", strings.NewReader(body))
+			req.Header.Set("Idempotency-Key", "abc")
+			handler.ServeHTTP(rr, testApp.contextSetUser(req, &data.User{ID: 1}))
+
+			if handled != e.handled {
+				t.Errorf("expected the handler to run: %v, but it ran: %v", e.handled, handled)
+			}
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+			if e.expectedBody != "" && rr.Body.String() != e.expectedBody {
+				t.Errorf("expected %s but got %s", e.expectedBody, rr.Body.String())
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != e.replayed {
+				t.Errorf("expected replayed to be %v", e.replayed)
+			}
+		})
+	}
+}
+
+func TestApplication_Idempotency_Skipped(t *testing.T) {
+	newMockDB(t) // no queries are expected
+
+	var tests = []struct {
+		name   string
+		method string
+		key    string
+		user   *data.User
+	}{
+		{"no key", "POST", "", &data.User{ID: 1}},
+		{"not mutating", "GET", "abc", &data.User{ID: 1}},
+		{"anonymous", "POST", "abc", nil},
+	}
+
+	for _, e := range tests {
+		handled := false
+		handler := testApp.Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled = true
+		}))
+
+		req, _ := http.NewRequest(e.method, "/", nil)
+		if e.key != "" {
+			req.Header.Set("Idempotency-Key", e.key)
+		}
+		if e.user != nil {
+			req = testApp.contextSetUser(req, e.user)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !handled {
+			t.Errorf("%s: expected the request to go straight through", e.name)
+		}
+	}
+}
+
+func TestApplication_Idempotency_Compressed(t *testing.T) {
+	mock := newMockDB(t)
+	const requestBody = `{"title": "It"}`
+	saved := `{"saved":"` + strings.Repeat("a", 2*compressMinSize) + `"}`
+
+	handler := testApp.Compress(testApp.Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"1"`)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(saved))
+	})))
+
+	send := func(acceptEncoding string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/books/save", strings.NewReader(requestBody))
+		req.Header.Set("Idempotency-Key", "abc")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		handler.ServeHTTP(rr, testApp.contextSetUser(req, &data.User{ID: 1}))
+		return rr
+	}
+
+	// the response is saved as the handler wrote it, not as it was compressed for this client
+	mock.ExpectQuery("insert into idempotency_keys").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("update idempotency_keys set status").
+		WithArgs(http.StatusAccepted, []byte(`{"Content-Type":["application/json"],"Etag":["\"1\""]}`), []byte(saved), 1, "abc").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if rr := send("gzip"); rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected the first response to be compressed, got %q", rr.Header().Get("Content-Encoding"))
+	}
+
+	// and the retries are compressed for whoever sends them
+	for _, encoding := range []string{"", "gzip"} {
+		mock.ExpectQuery("insert into idempotency_keys").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery("select (.+) from idempotency_keys").
+			WillReturnRows(sqlmock.NewRows(idempotencyColumns).
+				AddRow(1, 1, "abc", requestHash(httptest.NewRequest("POST", "/admin/books/save", nil), []byte(requestBody)), http.StatusAccepted,
+					[]byte(`{"Content-Type":["application/json"],"Etag":["\"1\""]}`), []byte(saved), time.Now(), time.Now().Add(time.Hour)))
+
+		rr := send(encoding)
+		if rr.Header().Get("Idempotent-Replayed") != "true" || rr.Header().Get("Content-Encoding") != encoding {
+			t.Fatalf("%q: expected a replay with Content-Encoding %q, got %q", encoding, encoding, rr.Header().Get("Content-Encoding"))
+		}
+
+		body := rr.Body.String()
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(zr)
+			body = string(b)
+		}
+		if body != saved {
+			t.Errorf("%q: the replayed body isn't the saved one", encoding)
+		}
+	}
+}
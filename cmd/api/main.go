@@ -3,51 +3,221 @@ package main
 import (
 	"Bookstore-Backend/internal/data"
 	"Bookstore-Backend/internal/driver"
+	"Bookstore-Backend/internal/logging"
+	"Bookstore-Backend/internal/ratelimit"
+	"Bookstore-Backend/internal/storage"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	shutdownDrainDelay = 5 * time.Second // how long readiness fails before we stop accepting connections
+	shutdownTimeout = 30 * time.Second // how long requests in flight get to finish
 )
 
 type config struct {
 	port int
+	oidc oidcConfig
+	trashRetention time.Duration // how long deleted books and users are kept before they are purged
+	cacheSize int // how many catalog reads are cached, 0 turns the cache off
+	cacheTTL time.Duration // how long a cached catalog read is used for
+	rateLimits map[string]ratelimit.Limit // per group of routes, see defaultRateLimits
+	trustedProxies []netip.Prefix // proxies whose X-Forwarded-For we believe
+	apiKeys map[string]string // api key -> name of the client it was given to
+	idempotencyRetention time.Duration // how long responses to requests with an Idempotency-Key are kept
+	exportTimeout time.Duration // how long an export of every book or user may take
+	metricsToken string // bearer token /metrics has to be called with, it is off without one
+	cors corsConfig
 }
 
 type application struct {
 	config  config // sharing configiration with application
-	infoLog *log.Logger // Logger
-	errorLog *log.Logger
+	logger *slog.Logger // structured, leveled logs, written as JSON
 	models data.Models
 	environment string
+	oidc *oidcAuthenticator // nil unless single sign on is configured
+	store storage.BlobStore // where book covers are kept
+	shutdown chan struct{} // closed once the server starts shutting down
+	limiter ratelimit.Store // nil when rate limiting is off
+	storeProbe *probeCache // the last readiness probe of the store, or nil to probe every time
 }
 
 
 func main() {
+	level := slog.LevelInfo
+	if name := os.Getenv("LOG_LEVEL"); name != "" {
+		l, err := logging.ParseLevel(name)
+		if err != nil {
+			log.Fatal("invalid LOG_LEVEL: ", err)
+		}
+		level = l
+	}
+
+	logger := logging.New(os.Stdout, level)
+	slog.SetDefault(logger) // anything still using the log package ends up in the same place
+
     var cfg config 
 	cfg.port = 8081 // will use 8081 port
 
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-   
+	cfg.trashRetention = 30 * 24 * time.Hour
+	if retention := os.Getenv("TRASH_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatal("invalid TRASH_RETENTION: ", err)
+		}
+		cfg.trashRetention = d
+	}
+
+	cfg.cacheSize = 1000
+	if size := os.Getenv("CATALOG_CACHE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			log.Fatal("invalid CATALOG_CACHE_SIZE: ", err)
+		}
+		cfg.cacheSize = n
+	}
+
+	cfg.cacheTTL = 5 * time.Minute
+	if ttl := os.Getenv("CATALOG_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal("invalid CATALOG_CACHE_TTL: ", err)
+		}
+		cfg.cacheTTL = d
+	}
+
+	cfg.idempotencyRetention = 24 * time.Hour
+	if retention := os.Getenv("IDEMPOTENCY_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatal("invalid IDEMPOTENCY_RETENTION: ", err)
+		}
+		cfg.idempotencyRetention = d
+	}
+
+	cfg.exportTimeout = 5 * time.Minute
+	if timeout := os.Getenv("EXPORT_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			log.Fatal("invalid EXPORT_TIMEOUT: ", err)
+		}
+		cfg.exportTimeout = d
+	}
+
+	cfg.metricsToken = os.Getenv("METRICS_TOKEN")
+	if cfg.metricsToken == "" {
+		logger.Warn("METRICS_TOKEN is not set, so /metrics can't be scraped")
+	}
+
+	cfg.rateLimits = make(map[string]ratelimit.Limit)
+	for group, limit := range defaultRateLimits {
+		if s := os.Getenv("RATE_LIMIT_" + strings.ToUpper(group)); s != "" {
+			l, err := ratelimit.ParseLimit(s)
+			if err != nil {
+				log.Fatalf("invalid RATE_LIMIT_%s: %v", strings.ToUpper(group), err)
+			}
+			limit = l
+		}
+		cfg.rateLimits[group] = limit
+	}
+
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("invalid TRUSTED_PROXIES: ", err)
+	}
+	cfg.trustedProxies = proxies
+
+	cfg.apiKeys, err = parseAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		log.Fatal("invalid API_KEYS: ", err)
+	}
+
+	// single sign on is optional, and only switched on when an issuer is set
+	cfg.oidc = oidcConfig{
+		issuer: os.Getenv("OIDC_ISSUER"),
+		clientID: os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL: os.Getenv("OIDC_REDIRECT_URL"),
+		autoCreate: os.Getenv("OIDC_AUTO_CREATE_USERS") == "true",
+		stateKey: os.Getenv("OIDC_STATE_KEY"),
+	}
+
 	// dsn means Data Source Name
 	dsn := "host=localhost port=5432 user=postgres password=0123321 dbname=bookkeeper sslmode=disable timezone=UTC connect_timeout=5"
 	environment := os.Getenv("ENV")
-    db, err := driver.ConnectPostgres(dsn) 
+
+	cfg.cors, err = loadCORSConfig(environment)
+	if err != nil {
+		log.Fatal("invalid CORS configuration: ", err)
+	}
+
+    db, err := driver.ConnectPostgres(dsn, logger) 
 	if err != nil{
-		log.Fatal("cannot connect to database")
+		log.Fatal("cannot connect to database: ", err)
 	}
+	logger.Info("connected to database")
 
 	defer db.SQL.Close()
+	registry.MustRegister(driver.NewStatsCollector(db.SQL))
 
 
 	app := &application{
 		config: cfg,
-		infoLog: infoLog,
-		errorLog: errorLog,
+		logger: logger,
 		models: data.New(db.SQL),
 		environment: environment,
+		shutdown: make(chan struct{}),
+		storeProbe: &probeCache{},
+	}
+
+	app.store, err = coverStore()
+	if err != nil {
+		log.Fatal("cannot set up cover storage: ", err)
+	}
+
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "memory":
+		app.limiter = ratelimit.NewMemory()
+	case "postgres":
+		// shared by every instance, so the limits hold however many there are
+		store := ratelimit.NewPostgres(db.SQL)
+		app.limiter = store
+		go app.purgeRateLimits(store, rateLimitPurgeInterval)
+	case "off":
+	default:
+		log.Fatalf("unknown RATE_LIMIT_STORE %q", os.Getenv("RATE_LIMIT_STORE"))
+	}
+
+	if cfg.oidc.issuer != "" {
+		app.oidc, err = newOIDCAuthenticator(context.Background(), cfg.oidc)
+		if err != nil {
+			log.Fatal("cannot discover OIDC provider: ", err)
+		}
+	}
+
+	data.ConfigureCache(cfg.cacheSize, cfg.cacheTTL)
+	data.ConfigureExports(cfg.exportTimeout)
+	if data.CacheEnabled() {
+		// other instances tell us when they change the catalog
+		go driver.Listen(context.Background(), dsn, data.CacheChannel, data.CacheNotified, logger)
 	}
 
+	go app.purgeTrash(trashPurgeInterval)
+	go app.purgeIdempotencyKeys(idempotencyPurgeInterval)
+
 	err = app.serve()
 	if err != nil{
        log.Fatal(err)
@@ -55,15 +225,84 @@ func main() {
 
 }
 
+// coverStore returns the store picked with COVER_STORE. Covers are kept on the local disk
+// unless it is set to s3.
+func coverStore() (storage.BlobStore, error) {
+	switch os.Getenv("COVER_STORE") {
+	case "", "local":
+		return storage.NewLocal(staticPath, "/static/"), nil
+	case "s3":
+		var presignTTL time.Duration
+		if ttl := os.Getenv("S3_PRESIGN_TTL"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil {
+				return nil, fmt.Errorf("invalid S3_PRESIGN_TTL: %w", err)
+			}
+			presignTTL = d
+		}
+
+		return storage.NewS3(storage.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PublicURL:       os.Getenv("S3_PUBLIC_URL"),
+			PresignTTL:      presignTTL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown COVER_STORE %q", os.Getenv("COVER_STORE"))
+	}
+}
+
 func(app *application) serve() error{ // serve was created was us
 
-	app.infoLog.Println("API Listening on port", app.config.port)
+	routes := app.routes()
+	if err := checkDevRoutes(app.environment, routes.(chi.Routes)); err != nil {
+		return err
+	}
+	if app.environment == "development" {
+		app.logger.Warn("development routes are served under /dev, anyone can act as any user")
+	}
+
+	app.logger.Info("API listening", "port", app.config.port)
     
 	srv := &http.Server{
 		Addr: fmt.Sprintf(":%d", app.config.port), // %d is the decimal, Addr is come from the Server
-		Handler: app.routes(),	
+		Handler: routes,	
+		ErrorLog: slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
-	return srv.ListenAndServe()
+	stopped := make(chan error, 1)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-quit
+
+		app.logger.Info("shutting down", "signal", sig.String())
+
+		// fail readiness first, and give the orchestrator time to notice before we stop
+		// accepting connections
+		close(app.shutdown)
+		time.Sleep(shutdownDrainDelay)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
 
-}  
\ No newline at end of file
+		stopped <- srv.Shutdown(ctx)
+	}()
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	// wait for the requests in flight to finish
+	err = <-stopped
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("server stopped")
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// registry holds every metric served on /metrics. We use our own rather than the default
+// one, so nothing ends up there just because some package imported Prometheus.
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookstore_http_requests_total",
+		Help: "Number of HTTP requests served, by route pattern, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bookstore_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route pattern, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookstore_logins_total",
+		Help: "Number of login attempts, by method and result.",
+	}, []string{"method", "result"})
+
+	tokenValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookstore_token_validations_total",
+		Help: "Number of token validations, by outcome.",
+	}, []string{"outcome"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bookstore_rate_limited_total",
+		Help: "Number of requests turned away by rate limiting, by route group.",
+	}, []string{"group"})
+
+	coverUploadBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "bookstore_cover_upload_bytes",
+		Help: "Size of uploaded cover images.",
+		// 16KiB up to 8MiB, just under the upload limit
+		Buckets: prometheus.ExponentialBuckets(16<<10, 2, 10),
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		loginAttempts,
+		tokenValidations,
+		rateLimited,
+		coverUploadBytes,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "bookstore_catalog_cache_hits_total",
+			Help: "Number of catalog reads served from the cache.",
+		}, func() float64 { return float64(data.CacheStats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "bookstore_catalog_cache_misses_total",
+			Help: "Number of catalog reads that went to the database.",
+		}, func() float64 { return float64(data.CacheStats().Misses) }),
+	)
+
+	// make sure the login series exist before the first login, so rates work from the start
+	for _, method := range []string{"password", "oidc"} {
+		for _, result := range []string{"success", "failure"} {
+			loginAttempts.WithLabelValues(method, result)
+		}
+	}
+}
+
+// routeLabelKey is the context key of the route label a handler can set, see setRouteLabel
+type routeLabelKey struct{}
+
+// Metrics records the count and latency of every request. Requests are labelled with the
+// route pattern rather than the path, so /books/{slug} is one series, not one per book.
+func (app *application) Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		label := new(string)
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), routeLabelKey{}, label)))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// paths that match no route could be anything, so they share one series
+		route := "unmatched"
+		if *label != "" {
+			route = *label
+		} else if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		labels := prometheus.Labels{"route": route, "method": r.Method, "status": strconv.Itoa(status)}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// setRouteLabel makes Metrics label the request with route, instead of its route pattern.
+// Middleware which turns a request away before it reaches its route uses it, since the
+// pattern would only be that of a mounted router by then.
+func setRouteLabel(r *http.Request, route string) {
+	if label, ok := r.Context().Value(routeLabelKey{}).(*string); ok {
+		*label = route
+	}
+}
+
+// MetricsAuth only lets requests with the bearer token in METRICS_TOKEN through. Metrics
+// say a lot about our traffic and the process, so without a token nobody gets them.
+func (app *application) MetricsAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || app.config.metricsToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(app.config.metricsToken)) != 1 {
+			app.errorJSON(w, r, &data.Error{Kind: data.ErrUnauthorized, Code: "unauthorized", Message: "invalid auth credentials"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordLogin counts a login attempt made with method
+func recordLogin(method string, ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	loginAttempts.WithLabelValues(method, result).Inc()
+}
+
+// recordTokenValidation counts the outcome of validating a token, err being what the
+// validation returned
+func recordTokenValidation(err error) {
+	var outcome string
+	switch {
+	case err == nil:
+		outcome = "valid"
+	case errors.Is(err, data.ErrTokenMissing):
+		outcome = "missing"
+	case errors.Is(err, data.ErrTokenMalformed):
+		outcome = "malformed"
+	case errors.Is(err, data.ErrTokenNotFound):
+		outcome = "unknown"
+	case errors.Is(err, data.ErrTokenExpired):
+		outcome = "expired"
+	case errors.Is(err, data.ErrUserInactive):
+		outcome = "inactive"
+	default:
+		outcome = "error"
+	}
+	tokenValidations.WithLabelValues(outcome).Inc()
+}
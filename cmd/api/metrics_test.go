@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplication_Metrics(t *testing.T) {
+	app := testApp
+	app.config.metricsToken = "scrape-me"
+	mux := app.routes()
+
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("unauthorized", "GET", "401"))
+
+	// an admin route without a token, which is counted as a missing token too
+	missing := testutil.ToFloat64(tokenValidations.WithLabelValues("missing"))
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/users/trash", nil)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatal("expected 401 but got", rr.Code)
+	}
+
+	// the middleware rejects the request before the route is matched, so every rejected
+	// request shares a label
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("unauthorized", "GET", "401")); got != before+1 {
+		t.Errorf("request not counted, got %v want %v", got, before+1)
+	}
+	if got := testutil.ToFloat64(tokenValidations.WithLabelValues("missing")); got != missing+1 {
+		t.Errorf("token validation not counted, got %v want %v", got, missing+1)
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape-me")
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatal("metrics returned wrong status code of", rr.Code)
+	}
+
+	for _, name := range []string{
+		`bookstore_http_requests_total{method="GET",route="unauthorized",status="401"}`,
+		"bookstore_http_request_duration_seconds_bucket",
+		`bookstore_logins_total{method="password",result="failure"}`,
+		`bookstore_token_validations_total{outcome="missing"}`,
+		"bookstore_catalog_cache_hits_total",
+	} {
+		if !strings.Contains(rr.Body.String(), name) {
+			t.Errorf("%s missing from metrics", name)
+		}
+	}
+}
+
+func TestApplication_MetricsAuth(t *testing.T) {
+	var tests = []struct {
+		name          string
+		token         string
+		authorization string
+		expectedCode  int
+	}{
+		{"no token set", "", "Bearer ", http.StatusUnauthorized},
+		{"no authorization", "scrape-me", "", http.StatusUnauthorized},
+		{"wrong token", "scrape-me", "Bearer guess", http.StatusUnauthorized},
+		{"right token", "scrape-me", "Bearer scrape-me", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		app := testApp
+		app.config.metricsToken = e.token
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		if e.authorization != "" {
+			req.Header.Set("Authorization", e.authorization)
+		}
+		app.routes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
@@ -1,20 +1,121 @@
 package main
 
-import "net/http"
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/logging"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// requestIDPattern is what we accept as a request id from clients, or a proxy in front of us
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
 
 func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler{
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.models.Token.AuthenticateToken(r)
+		user, err := app.models.Token.AuthenticateToken(r)
+		recordTokenValidation(err)
 		if err != nil{
-			payload := jsonResponse{
-				Error: true,
-				Message: "invalid auth credentials",				
+			// the message stays vague, but the code says why, so clients know when to log in again
+			authErr := &data.Error{Kind: data.ErrUnauthorized, Code: "unauthorized", Message: "invalid auth credentials", Err: err}
+
+			var dataErr *data.Error
+			if errors.As(err, &dataErr) {
+				authErr.Code = dataErr.Code
 			}
 
-			_ = app.writeJSON(w, http.StatusUnauthorized, payload)
+			// every route below is rejected the same way, so they share one series
+			setRouteLabel(r, "unauthorized")
+			app.errorJSON(w, r, authErr)
 			return
 		}
-		// If we pass the error check
+		// If we pass the error check, let the handlers know who is asking
+		next.ServeHTTP(w, app.contextSetUser(r, user))
+	})
+}
+
+// RequestID gives every request an id, which is sent back in the X-Request-ID header and
+// carried in the request's context, so every log line about the request has it. A well
+// formed id sent by the client is kept, so requests can be followed across services.
+func (app *application) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			_, _ = rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// AccessLog logs every request once it has been served, with its status and latency.
+// Only the path is logged, since query strings can hold tokens.
+func (app *application) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK // nothing was written at all
+		}
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+
+		app.logger.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("ip", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
+
+// Recoverer turns a panic in a handler into a 500, and logs it with its stack. chi's
+// Recoverer swallows http.ErrAbortHandler, which handlers panic with to break off a
+// response they can't finish, like an export which failed halfway. It is passed on
+// here, so net/http drops the connection and the client sees the response failed.
+func (app *application) Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rvr := recover()
+			if rvr == nil {
+				return
+			}
+			if rvr == http.ErrAbortHandler {
+				panic(rvr)
+			}
+
+			app.logger.ErrorContext(r.Context(), "panic", "error", fmt.Sprint(rvr), "stack", string(debug.Stack()))
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+
 		next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
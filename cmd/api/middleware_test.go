@@ -0,0 +1,112 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/logging"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestApplication_RequestID(t *testing.T) {
+	var seen string
+	handler := testApp.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	var tests = []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"generated", "", false},
+		{"kept", "abc-123.def_4", true},
+		{"bad characters", "abc\n123", false},
+		{"too long", strings.Repeat("a", 65), false},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		if e.header != "" {
+			req.Header.Set("X-Request-ID", e.header)
+		}
+
+		handler.ServeHTTP(rr, req)
+
+		id := rr.Header().Get("X-Request-ID")
+		if id == "" || id != seen {
+			t.Errorf("%s: response id %q doesn't match context id %q", e.name, id, seen)
+		}
+		if (id == e.header) != e.keep {
+			t.Errorf("%s: got id %q for header %q", e.name, id, e.header)
+		}
+	}
+}
+
+func TestApplication_AccessLog(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectQuery("where email = \\$1").WithArgs("admin@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+
+	var buf bytes.Buffer
+	app := testApp
+	app.logger = logging.New(&buf, slog.LevelDebug)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/users/login?token=hunter2", strings.NewReader(`{"email":"admin@example.com","password":"hunter2"}`))
+	req.Header.Set("X-Request-ID", "req-1")
+	app.routes().ServeHTTP(rr, req)
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("secret was logged: %s", buf.String())
+	}
+
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not json: %s", line)
+		}
+		if entry["request_id"] != "req-1" {
+			t.Errorf("log line without request id: %s", line)
+		}
+		if entry["msg"] == "request" {
+			found = true
+			if entry["route"] != "/users/login" || entry["path"] != "/users/login" || entry["status"] != float64(rr.Code) {
+				t.Errorf("unexpected access log %s", line)
+			}
+		}
+	}
+
+	if !found {
+		t.Errorf("request was not logged: %s", buf.String())
+	}
+}
+
+func TestApplication_Recoverer(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	testApp.Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rr.Code)
+	}
+
+	// aborting is left to net/http
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected http.ErrAbortHandler to be passed on, got %v", p)
+		}
+	}()
+	testApp.Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcLoginTTL is how long a user has to finish logging in at the identity provider
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcLoginCookie holds the state of a login in the user's browser, between sending them
+// to the identity provider and the provider sending them back
+const oidcLoginCookie = "oidc_login"
+
+// oidcConfig holds the settings for single sign on against an external identity provider
+type oidcConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	autoCreate   bool   // create users on their first login if they don't exist yet
+	stateKey     string // signs the login cookie, derived from clientSecret when empty
+}
+
+// oidcAuthenticator runs the authorization code flow (with PKCE) against a discovered provider
+type oidcAuthenticator struct {
+	verifier   *oidc.IDTokenVerifier
+	oauth2     oauth2.Config
+	autoCreate bool
+	stateKey   []byte
+	secure     bool // only send the login cookie over https
+}
+
+// oidcLoginState is what we have to remember between sending a user to the provider
+// and the provider sending them back to us. It is kept in a signed cookie rather than
+// on the server, so any instance can finish a login, and only in the browser which
+// started it.
+type oidcLoginState struct {
+	State        string    `json:"state"`
+	CodeVerifier string    `json:"code_verifier"`
+	Nonce        string    `json:"nonce"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// oidcClaims are the ID token claims we use to find or create a user
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+	Nonce         string `json:"nonce"`
+}
+
+// newOIDCAuthenticator discovers the provider's endpoints and keys from its issuer url
+func newOIDCAuthenticator(ctx context.Context, cfg oidcConfig) (*oidcAuthenticator, error) {
+	stateKey := []byte(cfg.stateKey)
+	if len(stateKey) == 0 {
+		if cfg.clientSecret == "" {
+			return nil, errors.New("a state key is needed when there is no client secret")
+		}
+		mac := hmac.New(sha256.New, []byte(cfg.clientSecret))
+		mac.Write([]byte(oidcLoginCookie))
+		stateKey = mac.Sum(nil)
+	}
+
+	provider, err := oidc.NewProvider(ctx, cfg.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oidcAuthenticator{
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.clientID}),
+		oauth2: oauth2.Config{
+			ClientID:     cfg.clientID,
+			ClientSecret: cfg.clientSecret,
+			RedirectURL:  cfg.redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		autoCreate: cfg.autoCreate,
+		stateKey:   stateKey,
+		secure:     strings.HasPrefix(cfg.redirectURL, "https://"),
+	}, nil
+}
+
+// begin starts a new login attempt. It returns the url to send the user to, and the
+// cookie which remembers the attempt in their browser.
+func (o *oidcAuthenticator) begin() (string, *http.Cookie, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	login := oidcLoginState{
+		State:        state,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        nonce,
+		Expiry:       time.Now().Add(oidcLoginTTL),
+	}
+
+	value, err := o.seal(login)
+	if err != nil {
+		return "", nil, err
+	}
+
+	authURL := o.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.CodeVerifier))
+	return authURL, o.cookie(value, int(oidcLoginTTL.Seconds())), nil
+}
+
+// cookie returns the login cookie with value. Lax is as strict as it can be, since the
+// provider sends the user back with a cross site redirect.
+func (o *oidcAuthenticator) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// seal encodes login as the value of the login cookie, signed so it can't be forged
+func (o *oidcAuthenticator) seal(login oidcLoginState) (string, error) {
+	payload, err := json.Marshal(login)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(o.sign(encoded)), nil
+}
+
+// open checks the signature of a login cookie's value and decodes it
+func (o *oidcAuthenticator) open(value string) (*oidcLoginState, error) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errors.New("malformed login cookie")
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, o.sign(encoded)) {
+		return nil, errors.New("login cookie has a bad signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var login oidcLoginState
+	if err := json.Unmarshal(payload, &login); err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+func (o *oidcAuthenticator) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, o.stateKey)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// complete exchanges the authorization code and returns the verified claims of the ID token.
+// The state must be the one in the login cookie of the browser the user came back with,
+// so a login can't be finished anywhere but where it was started.
+func (o *oidcAuthenticator) complete(ctx context.Context, cookie *http.Cookie, state, code string) (*oidcClaims, error) {
+	if cookie == nil {
+		return nil, errors.New("no login cookie")
+	}
+
+	pending, err := o.open(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	if pending.Expiry.Before(time.Now()) {
+		return nil, errors.New("expired login state")
+	}
+
+	if state == "" || !hmac.Equal([]byte(state), []byte(pending.State)) {
+		return nil, errors.New("login state does not match the cookie")
+	}
+
+	token, err := o.oauth2.Exchange(ctx, code, oauth2.VerifierOption(pending.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	if claims.Nonce != pending.Nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errors.New("identity provider did not return a verified email")
+	}
+
+	return &claims, nil
+}
+
+// OIDCLogin sends the user to the identity provider to log in
+func (app *application) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, cookie, err := app.oidc.begin()
+	if err != nil {
+		app.errorJSON(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback is where the identity provider sends the user back to. It maps the
+// ID token to one of our users and issues a normal api token, just like Login.
+func (app *application) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// every login cookie is used once, whatever happens next
+	cookie, _ := r.Cookie(oidcLoginCookie)
+	http.SetCookie(w, app.oidc.cookie("", -1))
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		recordLogin("oidc", false)
+		app.errorJSON(w, r, errors.New("login failed at identity provider: "+providerErr), http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := app.oidc.complete(r.Context(), cookie, query.Get("state"), query.Get("code"))
+	if err != nil {
+		app.logger.WarnContext(r.Context(), "single sign on failed", "error", err)
+		recordLogin("oidc", false)
+		app.errorJSON(w, r, errors.New("invalid single sign on response"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.userForClaims(r.Context(), claims)
+	if err != nil {
+		app.logger.WarnContext(r.Context(), "no user for single sign on", "email", claims.Email, "error", err)
+		recordLogin("oidc", false)
+		app.errorJSON(w, r, errors.New("no matching user"), http.StatusUnauthorized)
+		return
+	}
+
+	if user.Active == 0 {
+		recordLogin("oidc", false)
+		app.errorJSON(w, r, errors.New("user is not active"))
+		return
+	}
+
+	token, err := app.newSession(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	recordLogin("oidc", true)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Logged in",
+		Data:    envelope{"token": token, "user": user},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// userForClaims looks up the user for the email in the claims, creating them
+// on the fly if that's switched on
+func (app *application) userForClaims(ctx context.Context, claims *oidcClaims) (*data.User, error) {
+	user, err := app.models.User.GetByEmail(ctx, claims.Email)
+	if err == nil {
+		return user, nil
+	}
+
+	if !errors.Is(err, data.ErrNotFound) || !app.oidc.autoCreate {
+		return nil, err
+	}
+
+	// sso users never log in with a password, so give them one nobody knows
+	password, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := app.models.User.Insert(ctx, data.User{
+		Email:     claims.Email,
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+		Password:  password,
+		Active:    1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	app.logger.InfoContext(ctx, "created user from single sign on", "user_id", id)
+
+	return app.models.User.GetOne(ctx, id)
+}
+
+// randomString returns n random bytes, url safe base64 encoded
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
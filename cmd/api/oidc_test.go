@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-jose/go-jose/v4"
+	"golang.org/x/oauth2"
+)
+
+// mockIdP is a tiny OpenID Connect provider, just enough to run the whole
+// authorization code flow against
+type mockIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	// claims are put in every ID token the provider issues
+	claims map[string]interface{}
+
+	mu    sync.Mutex
+	codes map[string]url.Values // authorization code -> the authorize request it was issued for
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{t: t, key: key, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &idp.key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+	}})
+}
+
+// authorize pretends the user logged in, and sends them back with a code
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "pkce required", http.StatusBadRequest)
+		return
+	}
+
+	code, _ := randomString(16)
+	idp.mu.Lock()
+	idp.codes[code] = query
+	idp.mu.Unlock()
+
+	back, _ := url.Parse(query.Get("redirect_uri"))
+	back.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+
+	idp.mu.Lock()
+	authorization, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	if oauth2.S256ChallengeFromVerifier(r.PostForm.Get("code_verifier")) != authorization.Get("code_challenge") {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   idp.URL,
+		"sub":   "user-1",
+		"aud":   authorization.Get("client_id"),
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": authorization.Get("nonce"),
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: idp.key, KeyID: "test"}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(claims)
+	signed, err := signer.Sign(body)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idToken, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// oidcRoutes returns our routes, with single sign on against idp switched on
+func oidcRoutes(t *testing.T, idp *mockIdP, autoCreate bool) http.Handler {
+	auth, err := newOIDCAuthenticator(context.Background(), oidcConfig{
+		issuer:       idp.URL,
+		clientID:     "bookstore",
+		clientSecret: "secret",
+		redirectURL:  "http://localhost/users/oidc/callback",
+		autoCreate:   autoCreate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := testApp
+	app.oidc = auth
+	return app.routes()
+}
+
+// oidcBegin logs in at the identity provider the way a browser would, and returns the
+// login cookie our api set, and the callback the provider sent the browser back to
+func oidcBegin(t *testing.T, routes http.Handler) (*http.Cookie, *url.URL) {
+	// our api sends the browser to the identity provider
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/users/oidc/login", nil)
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatal("login returned wrong status code of", rr.Code)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcLoginCookie || !cookies[0].HttpOnly {
+		t.Fatalf("expected an http only login cookie, got %v", cookies)
+	}
+
+	// the identity provider sends it back with a code
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, _ := url.Parse(res.Header.Get("Location"))
+	return cookies[0], callback
+}
+
+// oidcCallback sends the browser, with cookie, to our callback
+func oidcCallback(routes http.Handler, cookie *http.Cookie, callback *url.URL) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", callback.RequestURI(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	routes.ServeHTTP(rr, req)
+	return rr
+}
+
+// oidcLogin runs the whole flow the way a browser would, and returns the response of our callback
+func oidcLogin(t *testing.T, idp *mockIdP, autoCreate bool) *httptest.ResponseRecorder {
+	routes := oidcRoutes(t, idp, autoCreate)
+	cookie, callback := oidcBegin(t, routes)
+	return oidcCallback(routes, cookie, callback)
+}
+
+var userColumns = []string{"id", "email", "first_name", "last_name", "password", "user_active", "created_at", "updated_at", "version"}
+
+func TestApplication_OIDCLogin_ExistingUser(t *testing.T) {
+	mock := newMockDB(t)
+	idp := newMockIdP(t)
+	idp.claims = map[string]interface{}{"email": "admin@example.com", "email_verified": true}
+
+	mock.ExpectQuery("from users where email = \\$1").WithArgs("admin@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(2, "admin@example.com", "Admin", "User", "hash", 1, time.Now(), time.Now(), 1))
+	mock.ExpectExec("delete\\s+from tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := oidcLogin(t, idp, false)
+	if rr.Code != http.StatusOK {
+		t.Fatal("callback returned wrong status code of", rr.Code, rr.Body.String())
+	}
+
+	var payload struct {
+		Data struct {
+			Token struct {
+				UserID int    `json:"user_id"`
+				Token  string `json:"token"`
+			} `json:"token"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+	if payload.Data.Token.UserID != 2 || len(payload.Data.Token.Token) != 26 {
+		t.Errorf("expected an api token for user 2, got %+v", payload.Data.Token)
+	}
+}
+
+func TestApplication_OIDCLogin_CreatesUser(t *testing.T) {
+	mock := newMockDB(t)
+	idp := newMockIdP(t)
+	idp.claims = map[string]interface{}{"email": "new@example.com", "email_verified": true, "given_name": "New", "family_name": "Person"}
+
+	mock.ExpectQuery("from users where email = \\$1").WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery("insert into users").
+		WithArgs("new@example.com", "New", "Person", sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery("from users where id = \\$1").WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "new@example.com", "New", "Person", "hash", 1, time.Now(), time.Now(), 1))
+	mock.ExpectExec("delete\\s+from tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := oidcLogin(t, idp, true)
+	if rr.Code != http.StatusOK {
+		t.Fatal("callback returned wrong status code of", rr.Code, rr.Body.String())
+	}
+}
+
+func TestApplication_OIDCLogin_RecreatesDeletedUser(t *testing.T) {
+	mock := newMockDB(t)
+	idp := newMockIdP(t)
+	idp.claims = map[string]interface{}{"email": "gone@example.com", "email_verified": true}
+
+	// a user with this email is in the trash. They aren't found, and since the email only
+	// has to be unique among users who aren't deleted, a new user can be created with it.
+	mock.ExpectQuery("from users where email = \\$1 and deleted_at is null").WithArgs("gone@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery("insert into users").WithArgs("gone@example.com", "", "", sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectQuery("from users where id = \\$1").WithArgs(8).
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(8, "gone@example.com", "", "", "hash", 1, time.Now(), time.Now(), 1))
+	mock.ExpectExec("delete\\s+from tokens").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := oidcLogin(t, idp, true)
+	if rr.Code != http.StatusOK {
+		t.Fatal("callback returned wrong status code of", rr.Code, rr.Body.String())
+	}
+}
+
+func TestApplication_OIDCLogin_Rejected(t *testing.T) {
+	var tests = []struct {
+		name       string
+		claims     map[string]interface{}
+		autoCreate bool
+		lookup     bool
+	}{
+		{"unverified email", map[string]interface{}{"email": "admin@example.com", "email_verified": false}, true, false},
+		{"unknown user", map[string]interface{}{"email": "nobody@example.com", "email_verified": true}, false, true},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			idp := newMockIdP(t)
+			idp.claims = e.claims
+
+			if e.lookup {
+				mock.ExpectQuery("from users where email = \\$1").WillReturnRows(sqlmock.NewRows(userColumns))
+			}
+
+			rr := oidcLogin(t, idp, e.autoCreate)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("expected 401 but got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestApplication_OIDCCallback_OtherBrowser(t *testing.T) {
+	newMockDB(t)
+	idp := newMockIdP(t)
+	idp.claims = map[string]interface{}{"email": "admin@example.com", "email_verified": true}
+	routes := oidcRoutes(t, idp, false)
+
+	// someone else's callback is no good without their cookie, even to a browser which
+	// started a login of its own
+	_, callback := oidcBegin(t, routes)
+	other, _ := oidcBegin(t, routes)
+
+	for _, cookie := range []*http.Cookie{nil, other} {
+		rr := oidcCallback(routes, cookie, callback)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 but got %d", rr.Code)
+		}
+
+		cleared := rr.Result().Cookies()
+		if len(cleared) != 1 || cleared[0].Name != oidcLoginCookie || cleared[0].MaxAge >= 0 {
+			t.Errorf("expected the login cookie to be cleared, got %v", cleared)
+		}
+	}
+}
+
+func TestOIDCAuthenticator_LoginCookie(t *testing.T) {
+	auth := &oidcAuthenticator{stateKey: []byte("key")}
+	forger := &oidcAuthenticator{stateKey: []byte("another key")}
+
+	valid, _ := auth.seal(oidcLoginState{State: "state", Expiry: time.Now().Add(time.Minute)})
+	expired, _ := auth.seal(oidcLoginState{State: "state", Expiry: time.Now().Add(-time.Minute)})
+	forged, _ := forger.seal(oidcLoginState{State: "state", Expiry: time.Now().Add(time.Minute)})
+
+	if login, err := auth.open(valid); err != nil || login.State != "state" {
+		t.Fatalf("expected the cookie to open, got %v, %v", login, err)
+	}
+
+	var tests = []struct {
+		name   string
+		cookie *http.Cookie
+		state  string
+	}{
+		{"no cookie", nil, "state"},
+		{"expired", &http.Cookie{Value: expired}, "state"},
+		{"forged", &http.Cookie{Value: forged}, "state"},
+		{"garbage", &http.Cookie{Value: "garbage"}, "state"},
+		{"other state", &http.Cookie{Value: valid}, "other"},
+		{"no state", &http.Cookie{Value: valid}, ""},
+	}
+
+	for _, e := range tests {
+		if _, err := auth.complete(context.Background(), e.cookie, e.state, "code"); err == nil {
+			t.Errorf("%s: expected the login to be rejected", e.name)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/cache"
+	"Bookstore-Backend/internal/data"
+	_ "embed"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// docsPage renders /openapi.json for people, without pulling anything in from a CDN
+//
+//go:embed docs.html
+var docsPage []byte
+
+// apiOperation documents a single route. Request and response bodies are given as values
+// of the Go types the handlers use, and their schemas are generated from those types, so
+// the spec can't drift from the code as long as every route is listed here.
+type apiOperation struct {
+	method  string
+	path    string // the chi pattern the route is registered with, without the version prefix
+	id      string // operationId, for client generators
+	summary string
+	tag     string
+	auth    bool // needs a bearer token
+
+	request     interface{} // value of the body's type, nil when there is no body
+	requestType string      // content type of the body, JSON when empty
+	query       []apiParam
+	headers     []apiParam
+
+	status   int         // status of a successful response, 200 when zero
+	response interface{} // value of the type in jsonResponse's data field, nil when there's none
+	raw      bool        // the response is response itself, not wrapped in jsonResponse
+	produces string      // content type of a response which isn't JSON
+	listing  bool        // the response can also be sent as CSV or NDJSON, see listFormats
+	created  bool        // 201 is sent instead of status when a record is created
+
+	unversioned   bool // the route isn't part of a version of the api, like /healthz
+	devOnly       bool // the route is only served in development
+	deprecated    bool
+	problemErrors bool // errors are always problem details
+}
+
+// apiParam is a query or header parameter
+type apiParam struct {
+	name        string
+	typ         string
+	format      string
+	description string
+}
+
+var (
+	ifMatch        = apiParam{name: "If-Match", typ: "string", description: "ETag of the version being changed; the change fails with 412 if it is stale"}
+	idempotencyKey = apiParam{name: "Idempotency-Key", typ: "string", description: "makes the request safe to retry: retries with the same key get the first response again"}
+	ifNoneMatch    = apiParam{name: "If-None-Match", typ: "string", description: "ETag of a cached response; 304 is returned if it is still current"}
+)
+
+// apiOperations lists every route in routes(), as it is in version 1 of the api. See
+// specOperations for the other versions.
+var apiOperations = []apiOperation{
+	// users and sessions
+	{method: "POST", path: "/users/login", id: "login", summary: "Log in with email and password", tag: "users",
+		request: credentials{}, response: envelope{"token": data.Token{}, "user": data.User{}}},
+	{method: "POST", path: "/users/logout", id: "logout", summary: "Log out, revoking a token", tag: "users",
+		request: tokenRequest{}},
+	{method: "GET", path: "/users/oidc/login", id: "oidcLogin", summary: "Start single sign on, redirecting to the identity provider", tag: "users",
+		status: http.StatusFound, raw: true},
+	{method: "GET", path: "/users/oidc/callback", id: "oidcCallback", summary: "Finish single sign on", tag: "users",
+		query:    []apiParam{{name: "code", typ: "string"}, {name: "state", typ: "string"}, {name: "error", typ: "string"}},
+		response: envelope{"token": data.Token{}, "user": data.User{}}},
+	{method: "POST", path: "/validate-token", id: "validateToken", summary: "Check whether a token is valid", tag: "users",
+		request: tokenRequest{}, response: true},
+
+	// catalog
+	{method: "GET", path: "/books", id: "listBooks", summary: "List the books in the catalog", tag: "catalog",
+		headers: []apiParam{ifNoneMatch}, listing: true, response: envelope{"books": []data.Book{}}},
+	{method: "POST", path: "/books", id: "listBooksPost", summary: "List the books in the catalog (for older clients)", tag: "catalog",
+		response: envelope{"books": []data.Book{}}},
+	{method: "GET", path: "/books/{slug}", id: "getBook", summary: "Get a book by its slug", tag: "catalog",
+		headers: []apiParam{ifNoneMatch}, response: data.Book{}},
+	{method: "GET", path: "/authors", id: "listAuthors", summary: "List the authors in the catalog", tag: "catalog",
+		headers: []apiParam{ifNoneMatch}, listing: true, response: envelope{"authors": []data.Author{}}},
+	{method: "GET", path: "/genres", id: "listGenres", summary: "List the genres in the catalog", tag: "catalog",
+		headers: []apiParam{ifNoneMatch}, listing: true, response: envelope{"genres": []data.Genre{}}},
+	{method: "GET", path: "/static/*", id: "getStatic", summary: "Get a static file, like a cover", tag: "catalog", unversioned: true,
+		raw: true, produces: "application/octet-stream"},
+	{method: "HEAD", path: "/static/*", id: "headStatic", summary: "Check a static file", tag: "catalog", unversioned: true,
+		raw: true},
+
+	// operations
+	{method: "GET", path: "/healthz", id: "healthz", summary: "Liveness", tag: "operations", unversioned: true},
+	{method: "GET", path: "/readyz", id: "readyz", summary: "Readiness, with the result of every check", tag: "operations", unversioned: true,
+		response: envelope{"checks": map[string]check{}}},
+	{method: "GET", path: "/metrics", id: "metrics", summary: "Prometheus metrics, with the token in METRICS_TOKEN as the bearer token", tag: "operations", unversioned: true,
+		auth: true, raw: true, produces: "text/plain"},
+	{method: "GET", path: "/openapi.json", id: "openapi", summary: "This document", tag: "operations", unversioned: true,
+		raw: true, response: map[string]interface{}{}},
+	{method: "GET", path: "/docs", id: "docs", summary: "Documentation for this api", tag: "operations", unversioned: true,
+		raw: true, produces: "text/html"},
+
+	// admin users
+	{method: "POST", path: "/admin/users", id: "listUsers", summary: "List users", tag: "admin users", auth: true,
+		response: envelope{"users": []data.User{}}},
+	{method: "GET", path: "/admin/users/export", id: "exportUsers", summary: "Export every user, streamed as JSON, CSV or NDJSON", tag: "admin users", auth: true,
+		listing: true, response: envelope{"users": []exportedUser{}}},
+	{method: "POST", path: "/admin/users/save", id: "saveUser", summary: "Create a user, or update one when an id is given", tag: "admin users", auth: true,
+		request: data.User{}, headers: []apiParam{ifMatch}, status: http.StatusAccepted},
+	{method: "POST", path: "/admin/users/get/{id}", id: "getUser", summary: "Get a user", tag: "admin users", auth: true,
+		raw: true, response: data.User{}},
+	{method: "PATCH", path: "/admin/users/{id}", id: "patchUser", summary: "Change some of a user's fields", tag: "admin users", auth: true,
+		request: userPatch{}, requestType: "application/merge-patch+json", headers: []apiParam{ifMatch}, response: data.User{}},
+	{method: "POST", path: "/admin/users/delete", id: "deleteUser", summary: "Move a user to the trash", tag: "admin users", auth: true,
+		request: idRequest{}},
+	{method: "GET", path: "/admin/users/trash", id: "listDeletedUsers", summary: "List users in the trash", tag: "admin users", auth: true,
+		response: envelope{"users": []data.User{}}},
+	{method: "POST", path: "/admin/users/restore", id: "restoreUser", summary: "Take a user back out of the trash", tag: "admin users", auth: true,
+		request: idRequest{}},
+	{method: "POST", path: "/admin/log-user-out/{id}", id: "logUserOut", summary: "Log a user out everywhere and deactivate them", tag: "admin users", auth: true,
+		status: http.StatusAccepted},
+
+	// admin books
+	{method: "POST", path: "/admin/authors/all", id: "authorOptions", summary: "List authors as select options", tag: "admin books", auth: true,
+		response: []selectData{}},
+	{method: "GET", path: "/admin/books/export", id: "exportBooks", summary: "Export every book, streamed as JSON, CSV or NDJSON", tag: "admin books", auth: true,
+		listing: true, response: envelope{"books": []data.Book{}}},
+	{method: "POST", path: "/admin/books/save", id: "saveBook", summary: "Create a book, or update one when an id is given", tag: "admin books", auth: true,
+		request: bookRequest{}, headers: []apiParam{ifMatch}, status: http.StatusAccepted},
+	{method: "POST", path: "/admin/books/delete", id: "deleteBook", summary: "Move a book to the trash", tag: "admin books", auth: true,
+		request: idRequest{}},
+	{method: "GET", path: "/admin/books/trash", id: "listDeletedBooks", summary: "List books in the trash", tag: "admin books", auth: true,
+		response: envelope{"books": []data.Book{}}},
+	{method: "POST", path: "/admin/books/restore", id: "restoreBook", summary: "Take a book back out of the trash", tag: "admin books", auth: true,
+		request: idRequest{}},
+	{method: "POST", path: "/admin/books/{id}", id: "getBookByID", summary: "Get a book by id", tag: "admin books", auth: true,
+		status: http.StatusAccepted, response: data.Book{}},
+	{method: "PATCH", path: "/admin/books/{id}", id: "patchBook", summary: "Change some of a book's fields", tag: "admin books", auth: true,
+		request: bookPatch{}, requestType: "application/merge-patch+json", headers: []apiParam{ifMatch}, response: data.Book{}},
+	{method: "PUT", path: "/admin/books/{id}/cover", id: "uploadCover", summary: "Upload a book's cover, as the body or the cover field of a form", tag: "admin books", auth: true,
+		requestType: "multipart/form-data", response: envelope{"covers": map[string]string{}}},
+	{method: "DELETE", path: "/admin/books/{id}/cover", id: "deleteCover", summary: "Remove a book's cover", tag: "admin books", auth: true},
+	{method: "GET", path: "/admin/covers/report", id: "coverReport", summary: "List orphaned and missing covers", tag: "admin books", auth: true,
+		response: coverReport{}},
+	{method: "POST", path: "/admin/covers/gc", id: "collectCovers", summary: "Remove orphaned covers now", tag: "admin books", auth: true,
+		response: envelope{"removed": []string{}}},
+	{method: "POST", path: "/admin/covers/migrate", id: "migrateCovers", summary: "Store covers kept by slug under their hash", tag: "admin books", auth: true,
+		response: coverMigration{}},
+
+	// admin operations
+	{method: "GET", path: "/admin/cache/stats", id: "cacheStats", summary: "Catalog cache statistics", tag: "admin operations", auth: true,
+		response: cache.Stats{}},
+	{method: "GET", path: "/admin/audit", id: "auditLogs", summary: "Search the audit log", tag: "admin operations", auth: true,
+		query: []apiParam{
+			{name: "action", typ: "string"},
+			{name: "target_type", typ: "string"},
+			{name: "target_id", typ: "integer"},
+			{name: "actor_id", typ: "integer"},
+			{name: "from", typ: "string", format: "date-time"},
+			{name: "to", typ: "string", format: "date-time"},
+			{name: "page", typ: "integer"},
+			{name: "page_size", typ: "integer", description: "at most " + strconv.Itoa(maxAuditPageSize)},
+		},
+		response: envelope{"entries": []data.AuditLog{}, "total": 0, "page": 0, "page_size": 0}},
+
+	// development tools, only served in development
+	{method: "POST", path: "/dev/users", id: "devAddUser", summary: "Add an active test user, with the password \"password\" unless one is given", tag: "development", unversioned: true, devOnly: true,
+		request: devUserRequest{}, status: http.StatusCreated, response: data.User{}},
+	{method: "POST", path: "/dev/tokens", id: "devMintToken", summary: "Mint a token for any user, to make requests as them", tag: "development", unversioned: true, devOnly: true,
+		request: devTokenRequest{}, status: http.StatusCreated, response: envelope{"token": data.Token{}, "user": data.User{}}},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+// OpenAPI serves the OpenAPI 3 document for the api
+func (app *application) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIDoc = openAPISpec(specOperations(app.environment == "development"))
+	})
+
+	_ = app.writeJSON(w, http.StatusOK, openAPIDoc)
+}
+
+// Docs serves a page which renders the OpenAPI document
+func (app *application) Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(docsPage)
+}
+
+// v2Change is how a route differs in version 2 of the api
+type v2Change struct {
+	removed bool
+	method  string
+	path    string
+	status  int
+	created bool
+	wrapped bool // the response is in a jsonResponse, where version 1 sent it on its own
+}
+
+// v2Changes are the routes which differ in version 2 of the api, by operationId. The
+// statuses and error format change everywhere, see apiVersion.
+var v2Changes = map[string]v2Change{
+	"listBooksPost": {removed: true},
+	"authorOptions": {removed: true},
+	"listUsers":     {method: "GET"},
+	"getUser":       {method: "GET", path: "/admin/users/{id}", wrapped: true},
+	"getBookByID":   {method: "GET", status: http.StatusOK},
+	"saveUser":      {status: http.StatusOK, created: true},
+	"saveBook":      {status: http.StatusOK, created: true},
+	"logUserOut":    {status: http.StatusOK},
+}
+
+// specOperations lists the operations of every version of the api: the unversioned
+// routes, then each route under /v1 and /v2, and at its old path without a version,
+// which is deprecated. Old paths keep their operationIds, so generated clients keep
+// working until they move to a version. The development routes are only listed with dev.
+func specOperations(dev bool) []apiOperation {
+	var unversioned, legacy, v1, v2 []apiOperation
+	for _, op := range apiOperations {
+		if op.devOnly && !dev {
+			continue
+		}
+		if op.unversioned {
+			unversioned = append(unversioned, op)
+			continue
+		}
+
+		old := op
+		old.deprecated = true
+		legacy = append(legacy, old)
+
+		op.path = "/v1" + old.path
+		op.id = "v1" + upperFirst(old.id)
+		v1 = append(v1, op)
+
+		change := v2Changes[old.id]
+		if change.removed {
+			continue
+		}
+		op.path = "/v2" + old.path
+		op.id = "v2" + upperFirst(old.id)
+		op.problemErrors = true
+		if change.method != "" {
+			op.method = change.method
+		}
+		if change.path != "" {
+			op.path = "/v2" + change.path
+		}
+		if change.status != 0 {
+			op.status = change.status
+		}
+		op.created = change.created
+		if change.wrapped {
+			op.raw = false
+		}
+		v2 = append(v2, op)
+	}
+
+	ops := append(unversioned, v1...)
+	ops = append(ops, v2...)
+	return append(ops, legacy...)
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// pathParam matches the parameters in a chi pattern
+var pathParam = regexp.MustCompile(`\{([^}:]+)(:[^}]+)?\}`)
+
+// specPath turns a chi pattern into an OpenAPI path
+func specPath(pattern string) string {
+	if strings.HasSuffix(pattern, "/*") {
+		pattern = strings.TrimSuffix(pattern, "*") + "{path}"
+	}
+	return pathParam.ReplaceAllString(pattern, "{$1}")
+}
+
+// openAPISpec builds the OpenAPI document for ops
+func openAPISpec(ops []apiOperation) map[string]interface{} {
+	g := &schemaGenerator{components: map[string]interface{}{}}
+
+	g.components["Response"] = obj{
+		"type": "object",
+		"properties": obj{
+			"error":   obj{"type": "boolean"},
+			"message": obj{"type": "string"},
+			"code":    obj{"type": "string", "description": "stable, machine readable error code"},
+			"data":    obj{},
+		},
+		"required": []string{"error", "message"},
+	}
+
+	paths := obj{}
+	for _, op := range ops {
+		path := specPath(op.path)
+		item, ok := paths[path].(obj)
+		if !ok {
+			item = obj{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = g.operation(op, path)
+	}
+
+	return obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":       "Bookstore API",
+			"version":     "2.0.0",
+			"description": "The api has two versions, under /v1 and /v2. Version 2 sends every error as problem details, and answers 200 or, for new records, 201 where version 1 answers 202. The routes without a version are version 1, and are deprecated. Responses are wrapped in a Response object, with the payload in its data field, unless noted otherwise.",
+		},
+		"paths": paths,
+		"components": obj{
+			"schemas": g.components,
+			"securitySchemes": obj{
+				"bearer": obj{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+type obj = map[string]interface{}
+
+func (g *schemaGenerator) operation(op apiOperation, path string) obj {
+	var params []interface{}
+	for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+		typ := "string"
+		if match[1] == "id" {
+			typ = "integer"
+		}
+		params = append(params, obj{"name": match[1], "in": "path", "required": true, "schema": obj{"type": typ}})
+	}
+	for _, p := range op.query {
+		params = append(params, p.spec("query"))
+	}
+	for _, p := range op.headers {
+		params = append(params, p.spec("header"))
+	}
+	if op.auth && mutating(op.method) {
+		params = append(params, idempotencyKey.spec("header"))
+	}
+
+	spec := obj{
+		"operationId": op.id,
+		"summary":     op.summary,
+		"tags":        []string{op.tag},
+		"responses":   g.responses(op),
+	}
+	if len(params) > 0 {
+		spec["parameters"] = params
+	}
+	if op.deprecated {
+		spec["deprecated"] = true
+	}
+	if op.auth {
+		spec["security"] = []interface{}{obj{"bearer": []string{}}}
+	}
+
+	switch {
+	case op.request != nil:
+		requestType := op.requestType
+		if requestType == "" {
+			requestType = "application/json"
+		}
+		spec["requestBody"] = obj{
+			"required": true,
+			"content":  obj{requestType: obj{"schema": g.schemaOf(op.request)}},
+		}
+	case op.requestType == "multipart/form-data":
+		spec["requestBody"] = obj{
+			"required": true,
+			"content": obj{
+				"multipart/form-data": obj{"schema": obj{
+					"type":       "object",
+					"properties": obj{"cover": obj{"type": "string", "format": "binary"}},
+				}},
+				"image/*": obj{"schema": obj{"type": "string", "format": "binary"}},
+			},
+		}
+	}
+
+	return spec
+}
+
+func (g *schemaGenerator) responses(op apiOperation) obj {
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	success := obj{"description": http.StatusText(status)}
+	switch {
+	case op.produces != "":
+		success["content"] = obj{op.produces: obj{"schema": obj{"type": "string"}}}
+	case op.raw && op.response != nil:
+		success["content"] = obj{"application/json": obj{"schema": g.schemaOf(op.response)}}
+	case op.raw:
+	case op.response != nil:
+		success["content"] = obj{"application/json": obj{"schema": obj{
+			"allOf": []interface{}{
+				ref("Response"),
+				obj{"type": "object", "properties": obj{"data": g.schemaOf(op.response)}},
+			},
+		}}}
+	default:
+		success["content"] = obj{"application/json": obj{"schema": ref("Response")}}
+	}
+	if op.listing {
+		content := success["content"].(obj)
+		for _, format := range listFormats[1:] {
+			content[format] = obj{"schema": obj{"type": "string"}}
+		}
+	}
+
+	responses := obj{strconv.Itoa(status): success}
+	if op.created {
+		created := obj{"description": http.StatusText(http.StatusCreated)}
+		if content, ok := success["content"]; ok {
+			created["content"] = content
+		}
+		responses[strconv.Itoa(http.StatusCreated)] = created
+	}
+
+	switch {
+	case op.produces != "":
+	case op.problemErrors:
+		responses["default"] = obj{
+			"description": "Error, as problem details",
+			"content":     obj{problemContentType: obj{"schema": g.schemaOf(problem{})}},
+		}
+	default:
+		responses["default"] = obj{
+			"description": "Error, as problem details when the client accepts " + problemContentType,
+			"content": obj{
+				"application/json": obj{"schema": ref("Response")},
+				problemContentType: obj{"schema": g.schemaOf(problem{})},
+			},
+		}
+	}
+
+	return responses
+}
+
+func (p apiParam) spec(in string) obj {
+	schema := obj{"type": p.typ}
+	if p.format != "" {
+		schema["format"] = p.format
+	}
+
+	spec := obj{"name": p.name, "in": in, "schema": schema}
+	if p.description != "" {
+		spec["description"] = p.description
+	}
+	return spec
+}
+
+func ref(name string) obj {
+	return obj{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaGenerator generates JSON schemas from Go types, the way encoding/json would
+// marshal them. Named structs become components, so they are only described once.
+type schemaGenerator struct {
+	components obj
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the schema of v. Envelopes are described by what is in them.
+func (g *schemaGenerator) schemaOf(v interface{}) obj {
+	if env, ok := v.(envelope); ok {
+		keys := make([]string, 0, len(env))
+		for key := range env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		properties := obj{}
+		for _, key := range keys {
+			properties[key] = g.schemaOf(env[key])
+		}
+		return obj{"type": "object", "properties": properties}
+	}
+
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) obj {
+	if t == nil {
+		return obj{}
+	}
+
+	switch {
+	case t == timeType:
+		return obj{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return obj{"type": "string", "format": "byte"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := g.schema(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return obj{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return obj{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return obj{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return obj{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return obj{"type": "number"}
+	case reflect.String:
+		return obj{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return obj{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return obj{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+
+		name := componentName(t)
+		if _, done := g.components[name]; !done {
+			g.components[name] = obj{} // placeholder, in case the type refers to itself
+			g.components[name] = g.structSchema(t)
+		}
+		return ref(name)
+	default:
+		// interface{} could be anything
+		return obj{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) obj {
+	properties := obj{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = g.schema(field.Type)
+	}
+
+	return obj{"type": "object", "properties": properties}
+}
+
+// componentName is the name a struct type is given in components, capitalised since some
+// of our types aren't exported
+func componentName(t reflect.Type) string {
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
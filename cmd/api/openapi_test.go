@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestOpenAPI_CoversEveryRoute(t *testing.T) {
+	app := testApp
+	app.oidc = &oidcAuthenticator{} // so the single sign on routes are registered too
+
+	spec := openAPISpec(specOperations(true))
+	paths := spec["paths"].(obj)
+
+	routes := app.routes().(chi.Router)
+	_ = chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		item, ok := paths[specPath(route)].(obj)
+		if !ok {
+			t.Errorf("%s is missing from the OpenAPI spec", route)
+			return nil
+		}
+		if _, ok := item[strings.ToLower(method)]; !ok {
+			t.Errorf("%s %s is missing from the OpenAPI spec", method, route)
+		}
+		return nil
+	})
+}
+
+func TestOpenAPI_Document(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	http.HandlerFunc(testApp.OpenAPI).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatal("OpenAPI returned wrong status code of", rr.Code)
+	}
+
+	var doc struct {
+		OpenAPI    string `json:"openapi"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("unexpected version %q", doc.OpenAPI)
+	}
+
+	// fields come from the json tags, and fields which are never sent are left out
+	book := doc.Components.Schemas["Book"].Properties
+	for _, name := range []string{"id", "title", "author", "genres", "deleted_at", "covers"} {
+		if _, ok := book[name]; !ok {
+			t.Errorf("Book is missing %s", name)
+		}
+	}
+	if _, ok := book["CoverHash"]; ok {
+		t.Error("Book has CoverHash, which is never sent")
+	}
+
+	for _, name := range []string{"Response", "User", "Token", "Credentials", "BookRequest", "AuditLog"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("%s is missing from the schemas", name)
+		}
+	}
+}
+
+func TestOpenAPI_Docs(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/docs", nil)
+	http.HandlerFunc(testApp.Docs).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/openapi.json") {
+		t.Error("docs page not served", rr.Code)
+	}
+}
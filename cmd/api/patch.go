@@ -0,0 +1,304 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/validator"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// errUnsupportedPatch is returned for PATCH bodies which aren't JSON merge patches
+var errUnsupportedPatch = errors.New("PATCH requests must be sent as application/merge-patch+json")
+
+// bookPatch holds the fields of a book which can be changed with PATCH
+type bookPatch struct {
+	Title           string `json:"title" validate:"required,max=255"`
+	AuthorID        int    `json:"author_id" validate:"required,min=1"`
+	PublicationYear int    `json:"publication_year" validate:"required,min=1"`
+	Description     string `json:"description"`
+	GenreIDs        []int  `json:"genre_ids"`
+}
+
+func (b bookPatch) Validate(v *validator.Validator) {
+	validatePublicationYear(v, b.PublicationYear)
+	validateGenreIDs(v, b.GenreIDs)
+}
+
+// userPatch holds the fields of a user which can be changed with PATCH. The password
+// can be set, but is never part of the document being patched.
+type userPatch struct {
+	Email     string `json:"email" validate:"required,email,max=255"`
+	FirstName string `json:"first_name" validate:"max=255"`
+	LastName  string `json:"last_name" validate:"max=255"`
+	Active    int    `json:"active" validate:"oneof=0 1"`
+	Password  string `json:"password,omitempty" validate:"max=72"`
+}
+
+// readMergePatch reads a JSON merge patch (RFC 7396) from the request body
+func (app *application) readMergePatch(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+		return nil, errUnsupportedPatch
+	}
+
+	maxBytes := 1048576 // same limit as readJSON
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	// a patch that isn't an object would replace the whole record, which never makes sense here
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return nil, errors.New("body must be a json object")
+	}
+
+	return body, nil
+}
+
+// applyMergePatch applies patch to the json representation of current, and decodes the
+// result into dst. Fields which aren't part of current's representation are rejected.
+func applyMergePatch(current interface{}, patch []byte, dst interface{}) error {
+	original, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	var target, p interface{}
+	if err := json.Unmarshal(original, &target); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return err
+	}
+
+	merged, err := json.Marshal(mergePatch(target, p))
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return errors.New("invalid patch: " + strings.TrimPrefix(err.Error(), "json: "))
+	}
+
+	return nil
+}
+
+// mergePatch implements the MergePatch algorithm from RFC 7396: objects are merged
+// recursively, null removes a member, and anything else replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+
+	return t
+}
+
+// patchError writes the response for an error from readMergePatch or applyMergePatch
+func (app *application) patchError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUnsupportedPatch) {
+		app.errorJSON(w, r, err, http.StatusUnsupportedMediaType)
+		return
+	}
+	app.errorJSON(w, r, err)
+}
+
+// PatchBook changes only the fields of a book which are in the merge patch
+func (app *application) PatchBook(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	patch, err := app.readMergePatch(w, r)
+	if err != nil {
+		app.patchError(w, r, err)
+		return
+	}
+
+	before, err := app.models.Book.GetOneById(r.Context(), bookID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	if !app.checkIfMatch(w, r, before, before.Version) {
+		return
+	}
+
+	current := bookPatch{
+		Title:           before.Title,
+		AuthorID:        before.AuthorID,
+		PublicationYear: before.PublicationYear,
+		Description:     before.Description,
+		GenreIDs:        before.GenreIDs,
+	}
+
+	var merged bookPatch
+	if err := applyMergePatch(current, patch, &merged); err != nil {
+		app.patchError(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Struct(merged)
+	if merged.AuthorID != before.AuthorID {
+		app.checkAuthor(r.Context(), v, merged.AuthorID)
+	}
+	if err := v.Err(); err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	book := data.Book{
+		ID:              before.ID,
+		Title:           merged.Title,
+		AuthorID:        merged.AuthorID,
+		PublicationYear: merged.PublicationYear,
+		Description:     merged.Description,
+		GenreIDs:        merged.GenreIDs,
+		GenresSet:       !slices.Equal(merged.GenreIDs, before.GenreIDs), // so [] or null clears them
+		Version:         before.Version,
+	}
+
+	if err := book.Update(r.Context()); err != nil {
+		if errors.Is(err, data.ErrEditConflict) {
+			if latest, err := app.models.Book.GetOneById(r.Context(), bookID); err == nil {
+				app.preconditionFailed(w, r, latest, latest.Version)
+				return
+			}
+		}
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	after, err := app.models.Book.GetOneById(r.Context(), bookID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	app.audit(r, "book.update", "book", bookID, before, after)
+	app.withCoverURLs(after)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Changes saved",
+		Data:    after,
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(after.Version))
+
+	_ = app.writeJSON(w, http.StatusOK, payload, headers)
+}
+
+// PatchUser changes only the fields of a user which are in the merge patch
+func (app *application) PatchUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	patch, err := app.readMergePatch(w, r)
+	if err != nil {
+		app.patchError(w, r, err)
+		return
+	}
+
+	u, err := app.models.User.GetOne(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+	u.Password = "" // never send the hash back, not even on a conflict
+
+	if !app.checkIfMatch(w, r, u, u.Version) {
+		return
+	}
+
+	current := userPatch{
+		Email:     u.Email,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Active:    u.Active,
+	}
+
+	var merged userPatch
+	if err := applyMergePatch(current, patch, &merged); err != nil {
+		app.patchError(w, r, err)
+		return
+	}
+
+	if err := validator.Validate(merged); err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	before := *u
+
+	u.Email = merged.Email
+	u.FirstName = merged.FirstName
+	u.LastName = merged.LastName
+	u.Active = merged.Active
+
+	if err := u.Update(r.Context()); err != nil {
+		if errors.Is(err, data.ErrEditConflict) {
+			if latest, err := app.models.User.GetOne(r.Context(), userID); err == nil {
+				latest.Password = ""
+				app.preconditionFailed(w, r, latest, latest.Version)
+				return
+			}
+		}
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	app.audit(r, "user.update", "user", userID, before, u)
+
+	if merged.Password != "" {
+		if err := u.ResetPassword(r.Context(), merged.Password); err != nil {
+			app.errorJSON(w, r, err)
+			return
+		}
+		app.audit(r, "user.password_reset", "user", userID, nil, nil)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Changes saved",
+		Data:    u,
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag(u.Version))
+
+	_ = app.writeJSON(w, http.StatusOK, payload, headers)
+}
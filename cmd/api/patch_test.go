@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func Test_mergePatch(t *testing.T) {
+	// test cases from appendix A of RFC 7396
+	var tests = []struct {
+		target, patch, expected string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, e := range tests {
+		var target, patch, expected interface{}
+		_ = json.Unmarshal([]byte(e.target), &target)
+		_ = json.Unmarshal([]byte(e.patch), &patch)
+		_ = json.Unmarshal([]byte(e.expected), &expected)
+
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, expected) {
+			t.Errorf("merging %s into %s: expected %s but got %v", e.patch, e.target, e.expected, got)
+		}
+	}
+}
+
+func TestApplication_PatchBook(t *testing.T) {
+	mock := newMockDB(t)
+	expectBookByID(mock, 3)
+
+	// only the title changes, everything else is written back as it was
+	mock.ExpectExec("update books set").
+		WithArgs("It (Special Edition)", 1, 1986, "it-special-edition", "", sqlmock.AnyArg(), 5, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectBookByID(mock, 4)
+	mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/admin/books/5", strings.NewReader(`{"title": "It (Special Edition)"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", `"3"`)
+	withURLParam(testApp.PatchBook, "id", "5").ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if got := rr.Header().Get("ETag"); got != `"4"` {
+		t.Errorf(`expected ETag "4" but got %s`, got)
+	}
+}
+
+func TestApplication_PatchBook_ClearsGenres(t *testing.T) {
+	for _, genres := range []string{`[]`, `null`} {
+		t.Run(genres, func(t *testing.T) {
+			mock := newMockDB(t)
+			mock.ExpectQuery("where b.id = \\$1").WithArgs(5).
+				WillReturnRows(sqlmock.NewRows(bookColumns).AddRow(5, "It", 1, 1986, "it", "", time.Now(), time.Now(), 3, "", 1, "Stephen King", time.Now(), time.Now()))
+			mock.ExpectQuery("from books_genres").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}).AddRow(1, "Horror", time.Now(), time.Now()))
+
+			// the book is saved, and its genres deleted without any being added back
+			mock.ExpectExec("update books set").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("delete from books_genres where book_id = \\$1").WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 1))
+			expectBookByID(mock, 4)
+			mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("PATCH", "/admin/books/5", strings.NewReader(`{"genre_ids": `+genres+`}`))
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+			req.Header.Set("If-Match", `"3"`)
+			withURLParam(testApp.PatchBook, "id", "5").ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("expected 200 but got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestApplication_PatchBook_Rejected(t *testing.T) {
+	var tests = []struct {
+		name         string
+		contentType  string
+		body         string
+		loadsBook    bool
+		expectedCode int
+	}{
+		{"not a merge patch", "text/plain", `{"title": "x"}`, false, http.StatusUnsupportedMediaType},
+		{"not an object", "application/merge-patch+json", `["title"]`, false, http.StatusBadRequest},
+		{"unknown field", "application/merge-patch+json", `{"slug": "x"}`, true, http.StatusBadRequest},
+		{"empty title", "application/merge-patch+json", `{"title": null}`, true, http.StatusUnprocessableEntity},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			if e.loadsBook {
+				expectBookByID(mock, 3)
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("PATCH", "/admin/books/5", strings.NewReader(e.body))
+			req.Header.Set("Content-Type", e.contentType)
+			req.Header.Set("If-Match", `"3"`)
+			withURLParam(testApp.PatchBook, "id", "5").ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
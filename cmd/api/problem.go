@@ -0,0 +1,71 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/logging"
+	"Bookstore-Backend/internal/validator"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	problemContentType = "application/problem+json"
+
+	// problemTypePrefix makes problem types out of our error codes. They are URNs, since
+	// they identify a kind of problem rather than a page to read about it.
+	problemTypePrefix = "urn:bookstore:problem:"
+)
+
+// problem is an error response in the RFC 7807 problem details format. It is sent instead
+// of jsonResponse to clients which ask for it.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	// extensions
+	Code      string           `json:"code"`
+	RequestID string           `json:"request_id,omitempty"`
+	Errors    validator.Errors `json:"errors,omitempty"` // problems with individual fields
+	Data      interface{}      `json:"data,omitempty"`   // whatever a jsonResponse would carry, like the current record on a conflict
+}
+
+// wantsProblem reports whether errors should be sent as problem details, which is
+// always the case in version 2 of the api, and otherwise when the client asks for them
+func wantsProblem(r *http.Request) bool {
+	if apiVersion(r) >= 2 {
+		return true
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || mediaType != problemContentType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// writeProblem fills in the members of p which follow from the request and its status,
+// and writes it
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, p problem, headers ...http.Header) {
+	p.Type = problemTypePrefix + p.Code
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = logging.RequestID(r.Context())
+
+	h := make(http.Header)
+	if len(headers) > 0 {
+		h = headers[0].Clone()
+	}
+	h.Set("Content-Type", problemContentType)
+
+	_ = app.writeJSON(w, p.Status, p, h)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/logging"
+	"Bookstore-Backend/internal/validator"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func Test_wantsProblem(t *testing.T) {
+	var tests = []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/problem+json", true},
+		{"application/json, application/problem+json;q=0.9", true},
+		{"application/problem+json;q=0", false},
+		{"*/*", false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", e.accept)
+
+		if got := wantsProblem(req); got != e.want {
+			t.Errorf("%q: got %v want %v", e.accept, got, e.want)
+		}
+	}
+}
+
+func Test_errorJSON_Problem(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/books/save", nil)
+	req.Header.Set("Accept", "application/problem+json")
+	req = req.WithContext(logging.WithRequestID(req.Context(), "req-1"))
+
+	err := validator.Errors{
+		{Field: "title", Code: "required", Message: "must be given"},
+		{Field: "publication_year", Code: "min", Message: "must be at least 1000"},
+	}
+	_ = testApp.errorJSON(rr, req, err)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatal("expected 422 but got", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("wrong content type %q", ct)
+	}
+
+	var p problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Type != "urn:bookstore:problem:validation_failed" || p.Title != "Unprocessable Entity" || p.Status != 422 ||
+		p.Instance != "/admin/books/save" || p.RequestID != "req-1" || len(p.Errors) != 2 || p.Errors[1].Field != "publication_year" {
+		t.Errorf("unexpected problem %+v", p)
+	}
+}
+
+func Test_errorJSON_Legacy(t *testing.T) {
+	// without asking for problem details, the frontend gets what it always got
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/users/login", nil)
+	_ = testApp.errorJSON(rr, req, errors.New("invalid username/password"))
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("wrong content type %q", ct)
+	}
+
+	var payload jsonResponse
+	_ = json.NewDecoder(rr.Body).Decode(&payload)
+
+	if !payload.Error || payload.Message != "invalid username/password" || payload.Code != "bad_request" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+}
+
+func TestApplication_Problem_NotFound(t *testing.T) {
+	mock := newMockDB(t)
+	mock.ExpectQuery("where b.slug = \\$1").WithArgs("missing").WillReturnRows(sqlmock.NewRows(bookColumns))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/books/missing", nil)
+	req.Header.Set("Accept", "application/json, application/problem+json")
+	http.Handler(withURLParam(testApp.OneBook, "slug", "missing")).ServeHTTP(rr, req)
+
+	var p problem
+	_ = json.NewDecoder(rr.Body).Decode(&p)
+
+	if rr.Code != http.StatusNotFound || p.Code != "not_found" || p.Status != http.StatusNotFound {
+		t.Errorf("unexpected response %d %+v", rr.Code, p)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/ratelimit"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitPurgeInterval is how often full buckets are deleted from a shared store
+const rateLimitPurgeInterval = 10 * time.Minute
+
+var errRateLimited = errors.New("too many requests, try again later")
+
+// defaultRateLimits are the limits of each group of routes, unless they are set with
+// RATE_LIMIT_<GROUP>
+var defaultRateLimits = map[string]ratelimit.Limit{
+	"auth":    {Requests: 10, Window: time.Minute},  // logging in and checking tokens, where guessing is the worry
+	"catalog": {Requests: 120, Window: time.Minute}, // public reads
+	"admin":   {Requests: 600, Window: time.Minute}, // the admin UI makes many requests per page
+}
+
+// rateLimit limits how often each client can call the routes of group. Clients are told
+// how much of the limit is left in the RateLimit-* headers, and how long to wait in
+// Retry-After once they have used it up. Every route of a group shares one limit.
+func (app *application) rateLimit(group string) func(http.Handler) http.Handler {
+	limit := app.config.rateLimits[group]
+
+	return func(next http.Handler) http.Handler {
+		if app.limiter == nil || !limit.Enabled() {
+			return next
+		}
+
+		policy := fmt.Sprintf("%d;w=%d", limit.Requests, int(math.Ceil(limit.Window.Seconds())))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, err := app.limiter.Take(r.Context(), group+":"+app.rateLimitKey(r), limit)
+			if err != nil {
+				// better to let everyone through than to lock everyone out
+				app.logger.ErrorContext(r.Context(), "cannot check rate limit", "group", group, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Policy", policy)
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+			if !result.Allowed {
+				rateLimited.WithLabelValues(group).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				app.errorJSON(w, r, errRateLimited, http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey identifies the client making r: the user on routes which need a token,
+// the client an api key was given to, or else the ip address it came from
+func (app *application) rateLimitKey(r *http.Request) string {
+	if user := app.contextGetUser(r); user != nil {
+		return "user:" + strconv.Itoa(user.ID)
+	}
+
+	if name, ok := app.config.apiKeys[r.Header.Get("X-API-Key")]; ok {
+		return "key:" + name
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+// parseAPIKeys reads a comma separated list of name:key pairs into a map from key to name
+func parseAPIKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for i, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		// the key itself is left out of errors, since they end up in logs
+		name, key, ok := strings.Cut(field, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("entry %d is not name:key", i+1)
+		}
+		keys[key] = name
+	}
+	return keys, nil
+}
+
+// purgeRateLimits deletes full buckets from store every interval, until the application exits
+func (app *application) purgeRateLimits(store *ratelimit.Postgres, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if _, err := store.Purge(ctx); err != nil {
+			app.logger.ErrorContext(ctx, "cannot purge rate limits", "error", err)
+		}
+		cancel()
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"Bookstore-Backend/internal/data"
+	"Bookstore-Backend/internal/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApplication_RateLimit(t *testing.T) {
+	app := testApp
+	app.limiter = ratelimit.NewMemory()
+	app.config.rateLimits = map[string]ratelimit.Limit{"auth": {Requests: 2, Window: time.Minute}}
+
+	handler := app.rateLimit("auth")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/users/login", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, remaining := range []string{"1", "0"} {
+		rr := send("192.0.2.1:1234")
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected the request through, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("RateLimit-Remaining"); got != remaining {
+			t.Errorf("expected %s remaining but got %s", remaining, got)
+		}
+	}
+
+	rr := send("192.0.2.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 but got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("expected Retry-After 30 but got %s", got)
+	}
+	if got := rr.Header().Get("RateLimit-Policy"); got != "2;w=60" {
+		t.Errorf("unexpected RateLimit-Policy %s", got)
+	}
+
+	// another client isn't affected
+	if rr := send("192.0.2.2:1234"); rr.Code != http.StatusNoContent {
+		t.Errorf("expected another client through, got %d", rr.Code)
+	}
+}
+
+func TestApplication_RateLimitKey(t *testing.T) {
+	app := testApp
+	app.config.apiKeys = map[string]string{"s3cret": "reports"}
+
+	var tests = []struct {
+		name     string
+		user     *data.User
+		apiKey   string
+		expected string
+	}{
+		{"user", &data.User{ID: 7}, "s3cret", "user:7"},
+		{"api key", nil, "s3cret", "key:reports"},
+		{"unknown api key", nil, "guess", "ip:192.0.2.1"},
+		{"anonymous", nil, "", "ip:192.0.2.1"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/books", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if e.apiKey != "" {
+			req.Header.Set("X-API-Key", e.apiKey)
+		}
+		if e.user != nil {
+			req = app.contextSetUser(req, e.user)
+		}
+
+		if got := app.rateLimitKey(req); got != e.expected {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expected, got)
+		}
+	}
+}
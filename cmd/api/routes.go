@@ -2,11 +2,8 @@ package main
 
 import (
 	"net/http"
-	"time"
-	"Bookstore-Backend/internal/data"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // routes generates our routes and attaches them to handlers, using the chi router
@@ -15,142 +12,169 @@ import (
 // that is part of the standard library.
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
-	mux.Use(middleware.Recoverer)
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins: []string{"https://*", "http://*"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders: []string{"Link"},
-		AllowCredentials: true,
-		MaxAge: 300,
-	}))
-
-	mux.Post("/users/login", app.Login)
-	mux.Post("/users/logout", app.Logout)
-
-	mux.Post("/books", app.AllBooks)
-	mux.Get("/books", app.AllBooks)
-	mux.Get("/books/{slug}", app.OneBook)
-
-	mux.Post("/validate-token", app.ValidateToken)
-
-    mux.Route("/admin", func(mux chi.Router){
-		mux.Use(app.AuthTokenMiddleware)
-		
-		mux.Post("/users", app.AllUsers)
-		mux.Post("/users/save", app.EditUser)
-		mux.Post("/users/get/{id}", app.Getuser)
-		mux.Post("/users/delete", app.DeleteUser)
-		mux.Post("/log-user-out/{id}", app.LogUserOutAndSetInactive)
-        
-		// admin book routes
-		mux.Post("/authors/all", app.AuthorsAll)
-		mux.Post("/books/save", app.EditBook)
-		mux.Post("/books/delete", app.DeleteBook)
-		mux.Post("/books/{id}", app.BookByID)
-		
+	mux.Use(app.RequestID)
+	mux.Use(app.ClientIP)
+	mux.Use(app.AccessLog)
+	mux.Use(app.Metrics)
+	mux.Use(app.Recoverer)
+	mux.Use(app.SecurityHeaders)
+	mux.Use(app.CORS())
+	mux.Use(app.Compress)
+
+	mux.Get("/healthz", app.Healthz)
+	mux.Get("/readyz", app.Readyz)
+	mux.With(app.MetricsAuth).Method("GET", "/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Get("/openapi.json", app.OpenAPI)
+	mux.Get("/docs", app.Docs)
+
+	mux.Mount("/v1", app.versionRoutes(1, app.v1Routes))
+	mux.Mount("/v2", app.versionRoutes(2, app.v2Routes))
+
+	// the api as it was before it had versions, which is /v1 now. It stays until legacySunset.
+	mux.Group(func(mux chi.Router) {
+		mux.Use(deprecated)
+		app.v1Routes(mux)
 	})
 
 	// static files
 
 	fileServer := http.FileServer(http.Dir("./static/"))
-	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+	static := http.StripPrefix("/static", staticSecurityHeaders(staticCacheControl(fileServer)))
+	mux.Method("GET", "/static/*", static)
+	mux.Method("HEAD", "/static/*", static)
 
-	
+	// tools for working locally, see devRoutes
+	if app.environment == "development" {
+		mux.Mount("/dev", app.devRoutes())
+	}
 
-	// testing for if they work or not
+	return mux
+}
 
-	mux.Get("/users/add", func(w http.ResponseWriter, r *http.Request){
-		var u = data.User{ // this part will be added to the db
-			Email: "you@there.com",
-			FirstName: "You",
-			LastName: "There",	
-			Password: "password",	
-		}
+// versionRoutes returns a router for one version of the api, with its routes registered by register
+func (app *application) versionRoutes(version int, register func(chi.Router)) http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(withAPIVersion(version))
+	register(mux)
+	return mux
+}
+
+// v1Routes registers the routes of version 1 of the api
+func (app *application) v1Routes(mux chi.Router) {
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.rateLimit("auth"))
 
-		app.infoLog.Println("Adding user...")
+		mux.Post("/users/login", app.Login)
+		mux.Post("/users/logout", app.Logout)
 
-		id, err := app.models.User.Insert(u)
-		if err != nil {
-			app.errorLog.Println(err)
-			app.errorJSON(w, err, http.StatusForbidden)
-			return
+		if app.oidc != nil {
+			mux.Get("/users/oidc/login", app.OIDCLogin)
+			mux.Get("/users/oidc/callback", app.OIDCCallback)
 		}
 
-		app.infoLog.Println("Got back id of", id)
-		
-		// we will get the user from db that's why we created newUser and ignored the error	
-		newUser, _ := app.models.User.GetOne(id)
-		app.writeJSON(w, http.StatusOK, newUser)
+		mux.Post("/validate-token", app.ValidateToken)
 	})
 
-	mux.Get("/test-generate-token", func(w http.ResponseWriter, r *http.Request){
-		token, err := app.models.User.Token.GenerateToken(2, 60*time.Minute)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.rateLimit("catalog"))
 
-		token.Email = "admin@example.com"
-		token.CreatedAt = time.Now()
-		token.UpdatedAt = time.Now()
+		mux.Post("/books", app.AllBooks)
+		mux.Get("/books", app.AllBooks)
+		mux.Get("/books/{slug}", app.OneBook)
+		mux.Get("/authors", app.Authors)
+		mux.Get("/genres", app.Genres)
+	})
 
-		payload := jsonResponse {
-			Error: false,
-			Message: "success",
-			Data: token,
-		}
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.AuthTokenMiddleware)
+		mux.Use(app.rateLimit("admin")) // after authentication, so each user has their own limit
+		mux.Use(app.Idempotency)
 
-		app.writeJSON(w, http.StatusOK, payload)
+		mux.Post("/users", app.AllUsers)
+		mux.Get("/users/export", app.ExportUsers)
+		mux.Post("/users/save", app.EditUser)
+		mux.Post("/users/get/{id}", app.Getuser)
+		mux.Patch("/users/{id}", app.PatchUser)
+		mux.Post("/users/delete", app.DeleteUser)
+		mux.Get("/users/trash", app.UsersTrash)
+		mux.Post("/users/restore", app.RestoreUser)
+		mux.Post("/log-user-out/{id}", app.LogUserOutAndSetInactive)
+
+		// admin book routes
+		mux.Post("/authors/all", app.AuthorsAll)
+		mux.Get("/books/export", app.ExportBooks)
+		mux.Post("/books/save", app.EditBook)
+		mux.Post("/books/delete", app.DeleteBook)
+		mux.Get("/books/trash", app.BooksTrash)
+		mux.Post("/books/restore", app.RestoreBook)
+		mux.Post("/books/{id}", app.BookByID)
+		mux.Patch("/books/{id}", app.PatchBook)
+		mux.Put("/books/{id}/cover", app.UploadCover)
+		mux.Delete("/books/{id}/cover", app.DeleteCover)
+		mux.Get("/covers/report", app.CoverReport)
+		mux.Post("/covers/gc", app.CollectCovers)
+		mux.Post("/covers/migrate", app.MigrateCovers)
+		mux.Get("/cache/stats", app.CacheStats)
+
+		mux.Get("/audit", app.AuditLogs)
 	})
+}
 
+// v2Routes registers the routes of version 2 of the api. Reads are GETs, without the POST
+// aliases, and the handlers answer with the statuses and error format of v2, see apiVersion.
+func (app *application) v2Routes(mux chi.Router) {
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.rateLimit("auth"))
 
-	mux.Get("/test-save-token", func(w http.ResponseWriter, r *http.Request){
-		token, err := app.models.User.Token.GenerateToken(2, 60*time.Minute)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
+		mux.Post("/users/login", app.Login)
+		mux.Post("/users/logout", app.Logout)
 
-		user, err := app.models.User.GetOne(2)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		if app.oidc != nil {
+			mux.Get("/users/oidc/login", app.OIDCLogin)
+			mux.Get("/users/oidc/callback", app.OIDCCallback)
 		}
 
-		token.UserID = user.ID
-		token.CreatedAt = time.Now()
-		token.UpdatedAt = time.Now()
-
-		err = token.Insert(*token, *user)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
-		}
+		mux.Post("/validate-token", app.ValidateToken)
+	})
 
-		payload := jsonResponse {
-			Error: false,
-			Message: "success",
-			Data: token,
-		}
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.rateLimit("catalog"))
 
-		app.writeJSON(w, http.StatusOK, payload)
-	})	
+		mux.Get("/books", app.AllBooks)
+		mux.Get("/books/{slug}", app.OneBook)
+		mux.Get("/authors", app.Authors) // replaces /admin/authors/all and its select options
+		mux.Get("/genres", app.Genres)
+	})
 
-	mux.Get("/test-validate-token", func(w http.ResponseWriter, r *http.Request){
-		tokenToValidate := r.URL.Query().Get("token")
-		valid, err := app.models.Token.ValidToken(tokenToValidate)
-		if err != nil {
-			app.errorJSON(w, err)
-			return
-		}
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.AuthTokenMiddleware)
+		mux.Use(app.rateLimit("admin"))
+		mux.Use(app.Idempotency)
 
-		var payload jsonResponse
-		payload.Error = false
-		payload.Data = valid
+		mux.Get("/users", app.AllUsers)
+		mux.Get("/users/export", app.ExportUsers)
+		mux.Post("/users/save", app.EditUser)
+		mux.Get("/users/{id}", app.Getuser)
+		mux.Patch("/users/{id}", app.PatchUser)
+		mux.Post("/users/delete", app.DeleteUser)
+		mux.Get("/users/trash", app.UsersTrash)
+		mux.Post("/users/restore", app.RestoreUser)
+		mux.Post("/log-user-out/{id}", app.LogUserOutAndSetInactive)
 
-		app.writeJSON(w, http.StatusOK, payload)
+		mux.Get("/books/export", app.ExportBooks)
+		mux.Post("/books/save", app.EditBook)
+		mux.Post("/books/delete", app.DeleteBook)
+		mux.Get("/books/trash", app.BooksTrash)
+		mux.Post("/books/restore", app.RestoreBook)
+		mux.Get("/books/{id}", app.BookByID)
+		mux.Patch("/books/{id}", app.PatchBook)
+		mux.Put("/books/{id}/cover", app.UploadCover)
+		mux.Delete("/books/{id}/cover", app.DeleteCover)
+		mux.Get("/covers/report", app.CoverReport)
+		mux.Post("/covers/gc", app.CollectCovers)
+		mux.Post("/covers/migrate", app.MigrateCovers)
+		mux.Get("/cache/stats", app.CacheStats)
+
+		mux.Get("/audit", app.AuditLogs)
 	})
-
-	return mux
 }
@@ -18,6 +18,21 @@ func Test_Routes_Exist(t *testing.T) {
 	routeExist(t, chiRoutes, "/admin/users/save")
 	routeExist(t, chiRoutes, "/admin/users")
 	routeExist(t, chiRoutes, "/admin/users/delete")
+	routeExist(t, chiRoutes, "/admin/users/restore")
+	routeExist(t, chiRoutes, "/admin/books/restore")
+	routeExist(t, chiRoutes, "/admin/audit")
+	routeExist(t, chiRoutes, "/admin/books/{id}/cover")
+	routeExist(t, chiRoutes, "/authors")
+	routeExist(t, chiRoutes, "/genres")
+	routeExist(t, chiRoutes, "/admin/covers/report")
+	routeExist(t, chiRoutes, "/admin/covers/gc")
+	routeExist(t, chiRoutes, "/admin/covers/migrate")
+	routeExist(t, chiRoutes, "/admin/cache/stats")
+	routeExist(t, chiRoutes, "/metrics")
+	routeExist(t, chiRoutes, "/healthz")
+	routeExist(t, chiRoutes, "/readyz")
+	routeExist(t, chiRoutes, "/openapi.json")
+	routeExist(t, chiRoutes, "/docs")
 
 }
 
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+// corsConfig says which web apps on other origins can call the api from a browser
+type corsConfig struct {
+	allowedOrigins   []string // may have one * each, like https://*.example.com
+	allowedMethods   []string
+	allowCredentials bool // whether browsers send cookies and Authorization along
+}
+
+// defaultCORSMethods are the methods the api uses
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// loadCORSConfig returns the CORS configuration for environment, with the defaults
+// overridden by CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS and CORS_ALLOW_CREDENTIALS.
+// Development allows the front end's dev server on localhost; everywhere else nothing
+// is allowed until origins are configured.
+func loadCORSConfig(environment string) (corsConfig, error) {
+	cfg := corsConfig{allowedMethods: defaultCORSMethods}
+	if environment == "development" {
+		cfg.allowedOrigins = []string{"http://localhost:*", "http://127.0.0.1:*"}
+		cfg.allowCredentials = true
+	}
+
+	if origins := os.Getenv("CORS_ALLOWED_ORIGINS"); origins != "" {
+		cfg.allowedOrigins = splitList(origins)
+	}
+	if methods := os.Getenv("CORS_ALLOWED_METHODS"); methods != "" {
+		cfg.allowedMethods = splitList(strings.ToUpper(methods))
+	}
+	if credentials := os.Getenv("CORS_ALLOW_CREDENTIALS"); credentials != "" {
+		allow, err := strconv.ParseBool(credentials)
+		if err != nil {
+			return cfg, errors.New("CORS_ALLOW_CREDENTIALS must be true or false")
+		}
+		cfg.allowCredentials = allow
+	}
+
+	// any site could then act as whoever is logged in
+	for _, origin := range cfg.allowedOrigins {
+		if cfg.allowCredentials && (origin == "*" || origin == "http://*" || origin == "https://*") {
+			return cfg, errors.New("credentials can't be allowed for every origin, list the origins instead")
+		}
+	}
+
+	return cfg, nil
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// CORS answers preflight requests and adds the CORS headers for the configured origins.
+// Without any origins there is nothing to add, and browsers keep other origins out.
+func (app *application) CORS() func(http.Handler) http.Handler {
+	cfg := app.config.cors
+	if len(cfg.allowedOrigins) == 0 {
+		// the cors package would take an empty list to mean every origin
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	return cors.Handler(cors.Options{
+		AllowedOrigins:   cfg.allowedOrigins,
+		AllowedMethods:   cfg.allowedMethods,
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "If-Match", "If-None-Match", "X-Request-ID", "X-API-Key", "Idempotency-Key"},
+		ExposedHeaders:   []string{"Link", "ETag", "X-Request-ID", "Deprecation", "Sunset", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "Idempotent-Replayed"},
+		AllowCredentials: cfg.allowCredentials,
+		MaxAge:           300,
+	})
+}
+
+// SecurityHeaders sets the headers which keep browsers from misusing our responses.
+// HSTS is left out in development, which is served over plain http.
+func (app *application) SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		h.Set("X-Frame-Options", "DENY")
+		if app.environment != "development" {
+			h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// staticCSP is the Content-Security-Policy of files served from /static. They are covers,
+// so they never need to run or load anything, even when opened on their own.
+const staticCSP = "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'none'; sandbox"
+
+// staticSecurityHeaders sets the Content-Security-Policy of static files
+func staticSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", staticCSP)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutes_CORS(t *testing.T) {
+	app := testApp
+	app.config.cors = corsConfig{
+		allowedOrigins:   []string{"https://admin.example.com"},
+		allowedMethods:   defaultCORSMethods,
+		allowCredentials: true,
+	}
+
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	var tests = []struct {
+		name    string
+		method  string
+		origin  string
+		allowed bool
+	}{
+		{"allowed preflight", "OPTIONS", "https://admin.example.com", true},
+		{"disallowed preflight", "OPTIONS", "https://evil.example.com", false},
+		{"lookalike preflight", "OPTIONS", "https://admin.example.com.evil.example", false},
+		{"allowed request", "GET", "https://admin.example.com", true},
+		{"disallowed request", "GET", "https://evil.example.com", false},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			req, _ := http.NewRequest(e.method, srv.URL+"/healthz", nil)
+			req.Header.Set("Origin", e.origin)
+			if e.method == "OPTIONS" {
+				req.Header.Set("Access-Control-Request-Method", "GET")
+			}
+
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			allowOrigin := resp.Header.Get("Access-Control-Allow-Origin")
+			if e.allowed && allowOrigin != e.origin {
+				t.Errorf("expected %s to be allowed, got %q", e.origin, allowOrigin)
+			}
+			if !e.allowed && allowOrigin != "" {
+				t.Errorf("expected %s to be rejected, got %q", e.origin, allowOrigin)
+			}
+			if e.allowed && resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+				t.Error("expected credentials to be allowed")
+			}
+		})
+	}
+}
+
+func TestRoutes_CORS_Unconfigured(t *testing.T) {
+	app := testApp
+	app.config.cors = corsConfig{}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	app.routes().ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("expected no origin to be allowed, got %q", got)
+	}
+}
+
+func Test_loadCORSConfig(t *testing.T) {
+	cfg, err := loadCORSConfig("development")
+	if err != nil || len(cfg.allowedOrigins) == 0 || !cfg.allowCredentials {
+		t.Errorf("expected localhost to be allowed in development, got %+v, %v", cfg, err)
+	}
+
+	cfg, err = loadCORSConfig("production")
+	if err != nil || len(cfg.allowedOrigins) != 0 {
+		t.Errorf("expected nothing to be allowed in production by default, got %+v, %v", cfg, err)
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://admin.example.com, https://*.example.org")
+	t.Setenv("CORS_ALLOWED_METHODS", "get,post")
+	cfg, err = loadCORSConfig("production")
+	if err != nil || len(cfg.allowedOrigins) != 2 || len(cfg.allowedMethods) != 2 || cfg.allowedMethods[0] != "GET" {
+		t.Errorf("expected the configured origins and methods, got %+v, %v", cfg, err)
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://*")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	if _, err := loadCORSConfig("production"); err == nil {
+		t.Error("expected credentials for every origin to be refused")
+	}
+}
+
+func TestApplication_SecurityHeaders(t *testing.T) {
+	app := testApp
+	app.environment = "production"
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	app.SecurityHeaders(http.HandlerFunc(app.Healthz)).ServeHTTP(rr, req)
+
+	for name, expected := range map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+		"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+	} {
+		if got := rr.Header().Get(name); got != expected {
+			t.Errorf("expected %s: %s but got %q", name, expected, got)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/static/covers/it.jpg", nil)
+	staticSecurityHeaders(http.NotFoundHandler()).ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("Content-Security-Policy"); got != staticCSP {
+		t.Errorf("expected the static CSP, got %q", got)
+	}
+}
@@ -2,29 +2,67 @@ package main
 
 import (
 	"Bookstore-Backend/internal/data"
-	"log"
+	"Bookstore-Backend/internal/logging"
+	"Bookstore-Backend/internal/storage"
+	"context"
+	"database/sql"
+	"net/http"
+	"log/slog"
 	"os"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
 )
 
 var testApp application
 var mockedDB sqlmock.Sqlmock
+var mockedConn *sql.DB
 
 func TestMain(m *testing.M) {
    testDB, myMock, _ := sqlmock.New()
    mockedDB = myMock
+   mockedConn = testDB
 
    defer testDB.Close()
 
    testApp = application{
 	config: config{},
-	infoLog: log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime),
-	errorLog: log.New(os.Stdout, "Error\t", log.Ldate|log.Ltime),
+	logger: logging.New(os.Stdout, slog.LevelInfo),
     models: data.New(testDB),
 	environment: "development",
+	store: storage.NewLocal(staticPath, "/static/"),
    }
 
    os.Exit(m.Run())
 }
+
+// newMockDB points the data layer at a fresh sqlmock connection for a single test,
+// so that expectations from one test can't leak into another
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testApp.models = data.New(db)
+
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+		testApp.models = data.New(mockedConn)
+	})
+
+	return mock
+}
+
+// withURLParam sets a chi url parameter before calling handler, the way the router would
+func withURLParam(handler http.HandlerFunc, key, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add(key, value)
+		handler(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx)))
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// trashPurgeInterval is how often we look for trashed books and users which are past the retention period
+const trashPurgeInterval = time.Hour
+
+// BooksTrash lists the books which have been deleted, but not purged yet
+func (app *application) BooksTrash(w http.ResponseWriter, r *http.Request) {
+	books, err := app.models.Book.GetDeleted(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"books": books},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RestoreBook takes a book back out of the trash
+func (app *application) RestoreBook(w http.ResponseWriter, r *http.Request) {
+	var requestPayload idRequest
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	err = app.models.Book.Restore(r.Context(), requestPayload.ID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	after, _ := app.models.Book.GetOneById(r.Context(), requestPayload.ID)
+	app.audit(r, "book.restore", "book", requestPayload.ID, nil, after)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Book restored",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// UsersTrash lists the users who have been deleted, but not purged yet
+func (app *application) UsersTrash(w http.ResponseWriter, r *http.Request) {
+	users, err := app.models.User.GetDeleted(r.Context())
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"users": users},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RestoreUser takes a user back out of the trash. They have to log in again, since
+// their tokens were removed when they were deleted.
+func (app *application) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload idRequest
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	err = app.models.User.Restore(r.Context(), requestPayload.ID)
+	if err != nil {
+		app.errorJSON(w, r, err)
+		return
+	}
+
+	after, _ := app.models.User.GetOne(r.Context(), requestPayload.ID)
+	app.audit(r, "user.restore", "user", requestPayload.ID, nil, after)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "User restored",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// purgeTrash permanently deletes everything that has been in the trash for longer than
+// the retention period, every interval, until the application exits
+func (app *application) purgeTrash(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.purgeTrashOnce()
+		<-ticker.C
+	}
+}
+
+func (app *application) purgeTrashOnce() {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-app.config.trashRetention)
+
+	books, err := app.models.Book.PurgeDeleted(ctx, cutoff)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "cannot purge deleted books", "error", err)
+	}
+
+	users, err := app.models.User.PurgeDeleted(ctx, cutoff)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "cannot purge deleted users", "error", err)
+	}
+
+	if books > 0 || users > 0 {
+		app.logger.InfoContext(ctx, "purged trash", "books", books, "users", users, "deleted_before", cutoff)
+	}
+
+	// purged books leave their covers behind, and so can uploads that never got saved
+	removed, err := app.collectCovers(ctx)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "cannot collect orphaned covers", "error", err)
+	}
+	if len(removed) > 0 {
+		app.logger.InfoContext(ctx, "collected orphaned covers", "renditions", len(removed))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
+)
+
+func TestApplication_RestoreBook(t *testing.T) {
+	var tests = []struct {
+		name         string
+		rowsAffected int64
+		expectedCode int
+	}{
+		{"in trash", 1, http.StatusOK},
+		{"not in trash", 0, http.StatusNotFound},
+		{"slug taken since", -1, http.StatusConflict},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+
+			// a book which was created after this one was deleted can have the same slug, in
+			// which case this one can't come back until that's sorted out
+			restore := mock.ExpectExec("update books set deleted_at = null").WithArgs(sqlmock.AnyArg(), 5)
+			if e.rowsAffected < 0 {
+				restore.WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "books_slug_live_key"})
+			} else {
+				restore.WillReturnResult(sqlmock.NewResult(0, e.rowsAffected))
+			}
+
+			if e.rowsAffected > 0 {
+				mock.ExpectQuery("where b.id = \\$1 and b.deleted_at is null").WithArgs(5).
+					WillReturnRows(sqlmock.NewRows(bookColumns).AddRow(5, "It", 1, 1986, "it", "", time.Now(), time.Now(), 3, "", 1, "Stephen King", time.Now(), time.Now()))
+				mock.ExpectQuery("from books_genres").WillReturnRows(sqlmock.NewRows([]string{"id", "genre_name", "created_at", "updated_at"}))
+				mock.ExpectExec("insert into audit_logs").WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/admin/books/restore", strings.NewReader(`{"id": 5}`))
+			http.HandlerFunc(testApp.RestoreBook).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected %d but got %d", e.expectedCode, rr.Code)
+			}
+		})
+	}
+}
+
+func TestApplication_PurgeTrash(t *testing.T) {
+	useTempStaticPath(t)
+	mock := newMockDB(t)
+
+	testApp.config.trashRetention = 24 * time.Hour
+	defer func() { testApp.config.trashRetention = 0 }()
+
+	cutoff := retentionCutoff{want: time.Now().Add(-24 * time.Hour)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("delete from books_genres").WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("delete from books where deleted_at < \\$1").WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("delete from tokens").WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("delete from users where deleted_at < \\$1").WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("where cover_hash is not null").WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "cover_hash", "deleted_at"}))
+
+	testApp.purgeTrashOnce()
+}
+
+// retentionCutoff matches a purge cutoff that is within a few seconds of want
+type retentionCutoff struct {
+	want time.Time
+}
+
+func (c retentionCutoff) Match(v driver.Value) bool {
+	got, ok := v.(time.Time)
+	if !ok {
+		return false
+	}
+	diff := got.Sub(c.want)
+	return diff > -5*time.Second && diff < 5*time.Second
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// legacyDeprecated is when the unversioned routes were deprecated in favour of /v1
+	legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+	// legacySunset is when the unversioned routes will be removed
+	legacySunset = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// withAPIVersion records which version of the api a request was made to, for the
+// handlers which answer differently in each, see apiVersion
+func withAPIVersion(version int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), apiVersionContextKey, version)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// apiVersion returns the version of the api r was made to. The unversioned routes are
+// version 1. Version 2 differs in that
+//
+//   - errors are always problem details
+//   - reads answer 200 rather than 202, and saves 201 for new records and 200 otherwise
+//   - a single user is sent in a jsonResponse, like everything else
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionContextKey).(int); ok {
+		return version
+	}
+	return 1
+}
+
+// deprecated marks responses from the unversioned routes as deprecated (RFC 9745), with
+// when they go away (RFC 8594) and where the same route is in /v1
+func deprecated(next http.Handler) http.Handler {
+	deprecation := "@" + strconv.FormatInt(legacyDeprecated.Unix(), 10)
+	sunset := legacySunset.Format(http.TimeFormat)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", deprecation)
+		w.Header().Set("Sunset", sunset)
+		w.Header().Add("Link", `</v1`+r.URL.EscapedPath()+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// savedStatus is the status for a record which was saved. Version 1 answers 202, even
+// though nothing is left to do by then.
+func savedStatus(r *http.Request, created bool) int {
+	switch {
+	case apiVersion(r) < 2:
+		return http.StatusAccepted
+	case created:
+		return http.StatusCreated
+	default:
+		return http.StatusOK
+	}
+}
+
+// doneStatus is the status for a request which was carried out there and then, which
+// version 1 answers with 202 in places
+func doneStatus(r *http.Request) int {
+	if apiVersion(r) < 2 {
+		return http.StatusAccepted
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutes_Versions(t *testing.T) {
+	routes := testApp.routes()
+
+	var tests = []struct {
+		name              string
+		method            string
+		path              string
+		expectedCode      int
+		expectedType      string
+		expectDeprecation bool
+	}{
+		{"legacy", "POST", "/admin/users", http.StatusUnauthorized, "application/json", true},
+		{"v1", "POST", "/v1/admin/users", http.StatusUnauthorized, "application/json", false},
+		{"v2", "GET", "/v2/admin/users", http.StatusUnauthorized, problemContentType, false},
+		{"v2 has no POST aliases", "POST", "/v2/books", http.StatusMethodNotAllowed, "", false},
+		{"unversioned operations", "GET", "/healthz", http.StatusOK, "application/json", false},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest(e.method, e.path, nil)
+			routes.ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Fatalf("expected %d but got %d: %s", e.expectedCode, rr.Code, rr.Body.String())
+			}
+
+			if e.expectedType != "" && rr.Header().Get("Content-Type") != e.expectedType {
+				t.Errorf("expected %s but got %s", e.expectedType, rr.Header().Get("Content-Type"))
+			}
+
+			deprecation, sunset, link := rr.Header().Get("Deprecation"), rr.Header().Get("Sunset"), rr.Header().Get("Link")
+			if !e.expectDeprecation {
+				if deprecation != "" || sunset != "" {
+					t.Errorf("unexpected deprecation headers %q and %q", deprecation, sunset)
+				}
+				return
+			}
+
+			if !strings.HasPrefix(deprecation, "@") {
+				t.Errorf("expected a Deprecation date but got %q", deprecation)
+			}
+			if sunset != legacySunset.Format(http.TimeFormat) {
+				t.Errorf("expected Sunset %s but got %q", legacySunset.Format(http.TimeFormat), sunset)
+			}
+			if link != `</v1/admin/users>; rel="successor-version"` {
+				t.Errorf("unexpected Link %q", link)
+			}
+		})
+	}
+}
+
+func TestApplication_VersionStatuses(t *testing.T) {
+	var tests = []struct {
+		name         string
+		version      int
+		expectedCode int
+	}{
+		{"v1", 1, http.StatusAccepted},
+		{"v2", 2, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			expectBookByID(mock, 3)
+
+			rr := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/admin/books/5", nil)
+			withAPIVersion(e.version)(withURLParam(testApp.BookByID, "id", "5")).ServeHTTP(rr, req)
+
+			if rr.Code != e.expectedCode {
+				t.Errorf("expected %d but got %d", e.expectedCode, rr.Code)
+			}
+		})
+	}
+}
+
+func Test_savedStatus(t *testing.T) {
+	var tests = []struct {
+		version  int
+		created  bool
+		expected int
+	}{
+		{1, true, http.StatusAccepted},
+		{1, false, http.StatusAccepted},
+		{2, true, http.StatusCreated},
+		{2, false, http.StatusOK},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/", nil)
+		var got int
+		withAPIVersion(e.version)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = savedStatus(r, e.created)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+
+		if got != e.expected {
+			t.Errorf("version %d, created %v: expected %d but got %d", e.version, e.created, e.expected, got)
+		}
+	}
+}
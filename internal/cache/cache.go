@@ -0,0 +1,157 @@
+// Package cache is a small in-memory cache, bounded both in size and in how long entries live.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Stats counts how well a cache is doing
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // entries dropped to make room, not counting expired ones
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+}
+
+// Cache keeps at most capacity entries, each for at most ttl. When it is full, the least
+// recently used entry makes room. It is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  map[K]*list.Element
+	order    *list.List // most recently used at the front
+	purges   uint64     // the generation, bumped by every Purge
+	stats    Stats
+	now      func() time.Time
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// New returns an empty cache
+func New[K comparable, V any](capacity int, ttl time.Duration) *Cache[K, V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &Cache[K, V]{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[K]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Get returns the value for key, if there is one that hasn't expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[K, V])
+		if c.now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			c.stats.Hits++
+			return e.value, true
+		}
+		c.remove(el)
+	}
+
+	c.stats.Misses++
+	var zero V
+	return zero, false
+}
+
+// Set stores value for key, replacing anything already there
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.set(key, value)
+}
+
+func (c *Cache[K, V]) set(key K, value V) {
+	expires := c.now().Add(c.ttl)
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expires: expires})
+
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Generation returns a number which changes with every Purge. Pass it to SetIfCurrent to
+// store a value which was loaded after it was taken.
+func (c *Cache[K, V]) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.purges
+}
+
+// SetIfCurrent stores value for key like Set, unless the cache was purged since generation
+// was taken. That way a value loaded before a purge, which may be stale, isn't stored
+// after it. It reports whether value was stored.
+func (c *Cache[K, V]) SetIfCurrent(key K, value V, generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.purges != generation {
+		return false
+	}
+
+	c.set(key, value)
+	return true
+}
+
+// Delete removes the value for key
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge removes every value
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[K]*list.Element)
+	c.order.Init()
+	c.purges++
+}
+
+// Stats returns the counters of the cache so far
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*entry[K, V]).key)
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[string, int](2, time.Minute)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // b is now the least recently used
+	c.Set("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if got, ok := c.Get(key); !ok || got != want {
+			t.Errorf("expected %s to be %d, got %d, %t", key, want, got, ok)
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCache_Expires(t *testing.T) {
+	now := time.Now()
+	c := New[string, int](10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Set("a", 1)
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get("a"); !ok {
+		t.Error("expected a to still be cached")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected a to have expired")
+	}
+
+	if c.Stats().Size != 0 {
+		t.Error("expected the expired entry to be removed")
+	}
+}
+
+func TestCache_DeleteAndPurge(t *testing.T) {
+	c := New[int, string](10, time.Minute)
+	c.Set(1, "one")
+	c.Set(2, "two")
+	c.Set(3, "three")
+
+	c.Delete(1)
+	if _, ok := c.Get(1); ok {
+		t.Error("expected 1 to be deleted")
+	}
+
+	c.Purge()
+	if c.Stats().Size != 0 {
+		t.Error("expected the cache to be empty")
+	}
+	if _, ok := c.Get(2); ok {
+		t.Error("expected 2 to be purged")
+	}
+}
+
+func TestCache_SetIfCurrent(t *testing.T) {
+	c := New[int, string](10, time.Minute)
+
+	generation := c.Generation()
+	if !c.SetIfCurrent(1, "one", generation) {
+		t.Error("expected a value loaded in the current generation to be stored")
+	}
+
+	// a purge while two is being loaded makes it stale
+	generation = c.Generation()
+	c.Purge()
+	if c.SetIfCurrent(2, "two", generation) {
+		t.Error("expected a value loaded before a purge to be turned down")
+	}
+	if _, ok := c.Get(2); ok {
+		t.Error("expected 2 not to be stored")
+	}
+}
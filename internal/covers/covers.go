@@ -0,0 +1,149 @@
+// Package covers turns uploaded book cover images into the normalized renditions we serve.
+package covers
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+
+	// decoders for the formats we accept
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/image/draw"
+)
+
+// Size is the name of one of the renditions kept for every cover
+type Size string
+
+const (
+	Small  Size = "small"
+	Medium Size = "medium"
+	Large  Size = "large"
+)
+
+// Sizes lists every rendition, smallest first
+var Sizes = []Size{Small, Medium, Large}
+
+// widths are the widths of the renditions in pixels. Images are never scaled up.
+var widths = map[Size]int{
+	Small:  200,
+	Medium: 400,
+	Large:  800,
+}
+
+const (
+	MaxBytes     = 10 << 20 // largest upload we accept, 10 MB
+	MaxDimension = 6000     // largest width or height in pixels
+	jpegQuality  = 85
+)
+
+var (
+	ErrTooLarge          = errors.New("cover image is too large")
+	ErrTooManyPixels     = errors.New("cover image dimensions are too large")
+	ErrUnsupportedFormat = errors.New("cover must be a jpeg, png, gif or webp image")
+)
+
+// allowedTypes are the sniffed content types we accept as covers
+var allowedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// Rendition is one normalized, resized copy of a cover, encoded as a JPEG
+type Rendition struct {
+	Size   Size
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// Process validates an uploaded image and returns its renditions. The type is decided by
+// sniffing the content, never by what the client claims. Re-encoding drops any metadata,
+// including EXIF, that came with the upload.
+func Process(src io.ReadSeeker) ([]Rendition, error) {
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxBytes {
+		return nil, ErrTooLarge
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrUnsupportedFormat
+	}
+	if !allowedTypes[http.DetectContentType(head[:n])] {
+		return nil, ErrUnsupportedFormat
+	}
+
+	// check the dimensions before decoding, so a tiny file can't make us allocate gigabytes
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	if cfg.Width > MaxDimension || cfg.Height > MaxDimension {
+		return nil, ErrTooManyPixels
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	var renditions []Rendition
+	for _, s := range Sizes {
+		rendition, err := resize(img, s)
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, rendition)
+	}
+
+	return renditions, nil
+}
+
+// resize scales img down to the width of size, flattening any transparency onto white
+func resize(img image.Image, size Size) (Rendition, error) {
+	bounds := img.Bounds()
+
+	width := widths[size]
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return Rendition{}, err
+	}
+
+	return Rendition{Size: size, Width: width, Height: height, Data: buf.Bytes()}, nil
+}
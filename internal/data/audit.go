@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// AuditLog is one entry in the append only log of administrative actions
+type AuditLog struct {
+	ID         int64                  `json:"id"`
+	ActorID    int                    `json:"actor_id"`
+	ActorEmail string                 `json:"actor_email"`
+	Action     string                 `json:"action"`
+	TargetType string                 `json:"target_type"`
+	TargetID   int                    `json:"target_id"`
+	Changes    map[string]AuditChange `json:"changes"`
+	IPAddress  string                 `json:"ip_address"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// AuditChange is the value of a single field before and after an action
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditFilter narrows down a listing of the audit log. Zero values mean "don't filter on this".
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   int
+	From       time.Time
+	To         time.Time
+	Page       int
+	PageSize   int
+}
+
+// auditIgnoredFields never end up in the audit log, either because they are
+// secrets or because they change on every write anyway
+var auditIgnoredFields = map[string]bool{
+	"password":   true,
+	"token":      true,
+	"updated_at": true,
+}
+
+// AuditDiff compares the json representations of before and after, and returns
+// the top level fields which differ. Either side may be nil, for creates and deletes.
+func AuditDiff(before, after interface{}) (map[string]AuditChange, error) {
+	b, err := toJSONMap(before)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	a, err := toJSONMap(after)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	changes := make(map[string]AuditChange)
+
+	for key, value := range b {
+		if !auditIgnoredFields[key] && !reflect.DeepEqual(value, a[key]) {
+			changes[key] = AuditChange{Before: value, After: a[key]}
+		}
+	}
+
+	for key, value := range a {
+		if _, seen := b[key]; !seen && !auditIgnoredFields[key] {
+			changes[key] = AuditChange{Before: nil, After: value}
+		}
+	}
+
+	return changes, nil
+}
+
+func toJSONMap(v interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return out, nil
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if err := json.Unmarshal(j, &out); err != nil {
+		return nil, dbError(err)
+	}
+	return out, nil
+}
+
+// Insert appends one entry to the audit log
+func (a *AuditLog) Insert(ctx context.Context, entry AuditLog) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if entry.Changes == nil {
+		entry.Changes = map[string]AuditChange{}
+	}
+
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return dbError(err)
+	}
+
+	stmt := `insert into audit_logs (actor_id, actor_email, action, target_type, target_id, changes, ip_address, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err = db.ExecContext(ctx, stmt,
+		entry.ActorID,
+		entry.ActorEmail,
+		entry.Action,
+		entry.TargetType,
+		entry.TargetID,
+		changes,
+		entry.IPAddress,
+		time.Now(),
+	)
+	if err != nil {
+		return dbError(err)
+	}
+
+	return nil
+}
+
+// GetAll returns one page of audit log entries matching filter, newest first,
+// along with the total number of matching entries
+func (a *AuditLog) GetAll(ctx context.Context, filter AuditFilter) ([]*AuditLog, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+
+	// addCondition appends a condition, numbering its placeholder as it goes
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.ActorID != 0 {
+		addCondition("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		addCondition("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		addCondition("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		addCondition("target_id = $%d", filter.TargetID)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at < $%d", filter.To)
+	}
+
+	query := `select id, actor_id, actor_email, action, target_type, target_id, changes, ip_address, created_at,
+		count(*) over() as total
+		from audit_logs`
+
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+
+	args = append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)
+	query += fmt.Sprintf(" order by created_at desc, id desc limit $%d offset $%d", len(args)-1, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, dbError(err)
+	}
+	defer rows.Close()
+
+	var entries []*AuditLog
+	var total int
+
+	for rows.Next() {
+		var entry AuditLog
+		var changes []byte
+
+		err := rows.Scan(
+			&entry.ID,
+			&entry.ActorID,
+			&entry.ActorEmail,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&changes,
+			&entry.IPAddress,
+			&entry.CreatedAt,
+			&total,
+		)
+		if err != nil {
+			return nil, 0, dbError(err)
+		}
+
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			return nil, 0, dbError(err)
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, dbError(err)
+	}
+
+	return entries, total, nil
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
@@ -11,17 +12,22 @@ import (
 
 // Book is the definition of a single book
 type Book struct {
-	ID              int       `json:"id"`
-	Title           string    `json:"title"`
-	AuthorID        int       `json:"author_id"`
-	PublicationYear int       `json:"publication_year"`
-	Slug            string    `json:"slug"`
-	Author          Author    `json:"author"`
-	Description     string    `json:"description"`
-	Genres          []Genre   `json:"genres"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
-	GenreIDs        []int     `json:"genre_ids,omitempty"`
+	ID              int               `json:"id"`
+	Title           string            `json:"title"`
+	AuthorID        int               `json:"author_id"`
+	PublicationYear int               `json:"publication_year"`
+	Slug            string            `json:"slug"`
+	Author          Author            `json:"author"`
+	Description     string            `json:"description"`
+	Genres          []Genre           `json:"genres"`
+	CreatedAt       time.Time         `json:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+	GenreIDs        []int             `json:"genre_ids,omitempty"`
+	GenresSet       bool              `json:"-"` // Update only replaces the genres with GenreIDs when this is set
+	DeletedAt       *time.Time        `json:"deleted_at,omitempty"`
+	Version         int               `json:"version"`
+	CoverHash       string            `json:"-"`                // hash of the cover's content, empty if there is none
+	Covers          map[string]string `json:"covers,omitempty"` // cover urls by size, filled in by the api
 }
 
 // Author is the definition of a single author
@@ -41,21 +47,26 @@ type Genre struct {
 }
 
 // GetAll returns a slice of all books
-func (b *Book) GetAll() ([]*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (b *Book) GetAll(ctx context.Context) ([]*Book, error) {
+	return cached(ctx, "books", b.getAll, cloneBooks)
+}
+
+func (b *Book) getAll(ctx context.Context) ([]*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
+	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at, b.version, coalesce(b.cover_hash, ''),
 			a.id, a.author_name, a.created_at, a.updated_at
 			from books b
 			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is null
 			order by b.title`
 
 	var books []*Book
 
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	defer rows.Close()
 
@@ -70,18 +81,20 @@ func (b *Book) GetAll() ([]*Book, error) {
 			&book.Description,
 			&book.CreatedAt,
 			&book.UpdatedAt,
+			&book.Version,
+			&book.CoverHash,
 			&book.Author.ID,
 			&book.Author.AuthorName,
 			&book.Author.CreatedAt,
 			&book.Author.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 
 		// get genres
-		genres, ids, err := b.genresForBook(book.ID)
+		genres, ids, err := b.genresForBook(ctx, book.ID)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 		book.Genres = genres
 		book.GenreIDs = ids
@@ -93,17 +106,23 @@ func (b *Book) GetAll() ([]*Book, error) {
 }
 
 // GetAllPaginated returns a slice of all books, paginated by limit and offset
-func (b *Book) GetAllPaginated(page, pageSize int) ([]*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (b *Book) GetAllPaginated(ctx context.Context, page, pageSize int) ([]*Book, error) {
+	load := func(ctx context.Context) ([]*Book, error) { return b.getAllPaginated(ctx, page, pageSize) }
+	return cached(ctx, fmt.Sprintf("books:%d:%d", page, pageSize), load, cloneBooks)
+}
+
+func (b *Book) getAllPaginated(ctx context.Context, page, pageSize int) ([]*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	limit := pageSize
 	offset := (page - 1) * pageSize
 
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
+	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at, b.version, coalesce(b.cover_hash, ''),
 			a.id, a.author_name, a.created_at, a.updated_at
 			from books b
 			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is null
 			order by b.title
 			limit $1 offset $2`
 
@@ -111,7 +130,7 @@ func (b *Book) GetAllPaginated(page, pageSize int) ([]*Book, error) {
 
 	rows, err := db.QueryContext(ctx, query, limit, offset)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	defer rows.Close()
 
@@ -126,18 +145,20 @@ func (b *Book) GetAllPaginated(page, pageSize int) ([]*Book, error) {
 			&book.Description,
 			&book.CreatedAt,
 			&book.UpdatedAt,
+			&book.Version,
+			&book.CoverHash,
 			&book.Author.ID,
 			&book.Author.AuthorName,
 			&book.Author.CreatedAt,
 			&book.Author.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 
 		// get genres
-		genres, ids, err := b.genresForBook(book.ID)
+		genres, ids, err := b.genresForBook(ctx, book.ID)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 		book.Genres = genres
 		book.GenreIDs = ids
@@ -148,16 +169,18 @@ func (b *Book) GetAllPaginated(page, pageSize int) ([]*Book, error) {
 	return books, nil
 }
 
-// GetOneById returns one book by its id
-func (b *Book) GetOneById(id int) (*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetOneById returns one book by its id. Unlike the other catalog reads it always goes to
+// the database: books are only looked up by id by admins about to change them, and the
+// version checked against If-Match, and kept in the audit log, has to be the saved one.
+func (b *Book) GetOneById(ctx context.Context, id int) (*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
+	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at, b.version, coalesce(b.cover_hash, ''),
 			a.id, a.author_name, a.created_at, a.updated_at
 			from books b
 			left join authors a on (b.author_id = a.id)
-			where b.id = $1`
+			where b.id = $1 and b.deleted_at is null`
 
 	row := db.QueryRowContext(ctx, query, id)
 
@@ -172,18 +195,20 @@ func (b *Book) GetOneById(id int) (*Book, error) {
 		&book.Description,
 		&book.CreatedAt,
 		&book.UpdatedAt,
+		&book.Version,
+		&book.CoverHash,
 		&book.Author.ID,
 		&book.Author.AuthorName,
 		&book.Author.CreatedAt,
 		&book.Author.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 
 	// get genres
-	genres, ids, err := b.genresForBook(book.ID)
+	genres, ids, err := b.genresForBook(ctx, book.ID)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	book.Genres = genres
 	book.GenreIDs = ids
@@ -192,15 +217,20 @@ func (b *Book) GetOneById(id int) (*Book, error) {
 }
 
 // GetOneBySlug returns one book by slug
-func (b *Book) GetOneBySlug(slug string) (*Book, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (b *Book) GetOneBySlug(ctx context.Context, slug string) (*Book, error) {
+	load := func(ctx context.Context) (*Book, error) { return b.getOneBySlug(ctx, slug) }
+	return cached(ctx, "book:slug:"+slug, load, cloneBook)
+}
+
+func (b *Book) getOneBySlug(ctx context.Context, slug string) (*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at,
+	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at, b.version, coalesce(b.cover_hash, ''),
 			a.id, a.author_name, a.created_at, a.updated_at
 			from books b
 			left join authors a on (b.author_id = a.id)
-			where b.slug = $1`
+			where b.slug = $1 and b.deleted_at is null`
 
 	row := db.QueryRowContext(ctx, query, slug)
 
@@ -215,18 +245,20 @@ func (b *Book) GetOneBySlug(slug string) (*Book, error) {
 		&book.Description,
 		&book.CreatedAt,
 		&book.UpdatedAt,
+		&book.Version,
+		&book.CoverHash,
 		&book.Author.ID,
 		&book.Author.AuthorName,
 		&book.Author.CreatedAt,
 		&book.Author.UpdatedAt)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 
 	// get genres
-	genres, ids, err := b.genresForBook(book.ID)
+	genres, ids, err := b.genresForBook(ctx, book.ID)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	book.Genres = genres
 	book.GenreIDs = ids
@@ -235,8 +267,8 @@ func (b *Book) GetOneBySlug(slug string) (*Book, error) {
 }
 
 // genresForBook returns all genres for a given book id
-func (b *Book) genresForBook(id int) ([]Genre, []int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (b *Book) genresForBook(ctx context.Context, id int) ([]Genre, []int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	// get genres
@@ -247,7 +279,7 @@ func (b *Book) genresForBook(id int) ([]Genre, []int, error) {
 
 	gRows, err := db.QueryContext(ctx, genreQuery, id)
 	if err != nil && err != sql.ErrNoRows {
-		return nil, nil, err
+		return nil, nil, dbError(err)
 	}
 	defer gRows.Close()
 
@@ -260,7 +292,7 @@ func (b *Book) genresForBook(id int) ([]Genre, []int, error) {
 			&genre.CreatedAt,
 			&genre.UpdatedAt)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, dbError(err)
 		}
 		genres = append(genres, genre)
 		genreIDs = append(genreIDs, genre.ID)
@@ -270,8 +302,8 @@ func (b *Book) genresForBook(id int) ([]Genre, []int, error) {
 }
 
 // Insert saves one book to the database
-func (b *Book) Insert(book Book) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (b *Book) Insert(ctx context.Context, book Book) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `insert into books (title, author_id, publication_year, slug, description, created_at, updated_at)
@@ -288,15 +320,16 @@ func (b *Book) Insert(book Book) (int, error) {
 		time.Now(),
 	).Scan(&newID)
 	if err != nil {
-		return 0, err
+		return 0, dbError(err)
 	}
+	defer invalidateCatalog(ctx)
 
 	// update genres using genre ids
 	if len(book.GenreIDs) > 0 {
 		stmt = `delete from books_genres where book_id = $1`
 		_, err := db.ExecContext(ctx, stmt, book.ID)
 		if err != nil {
-			return newID, fmt.Errorf("book updated, but genres not: %s", err.Error())
+			return newID, dbError(fmt.Errorf("book updated, but genres not: %w", err))
 		}
 
 		// add new genres
@@ -305,7 +338,7 @@ func (b *Book) Insert(book Book) (int, error) {
 				values ($1, $2, $3, $4)`
 			_, err = db.ExecContext(ctx, stmt, newID, x, time.Now(), time.Now())
 			if err != nil {
-				return newID, fmt.Errorf("book updated, but genres not: %s", err.Error())
+				return newID, dbError(fmt.Errorf("book updated, but genres not: %w", err))
 			}
 		}
 	}
@@ -313,9 +346,10 @@ func (b *Book) Insert(book Book) (int, error) {
 	return newID, nil
 }
 
-// Update updates one book in the database
-func (b *Book) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Update updates one book in the database, as long as it is still at b.Version.
+// If someone else saved the book in the meantime, ErrEditConflict is returned.
+func (b *Book) Update(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `update books set
@@ -324,27 +358,38 @@ func (b *Book) Update() error {
 		publication_year = $3,
         slug = $4,
     	description = $5,
-		updated_at = $6
-		where id = $7`
+		updated_at = $6,
+		version = version + 1
+		where id = $7 and version = $8 and deleted_at is null`
 
-	_, err := db.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		b.Title,
 		b.AuthorID,
 		b.PublicationYear,
 		slugify.Slugify(b.Title),
 		b.Description,
 		time.Now(),
-		b.ID)
+		b.ID,
+		b.Version)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
-	// update genres using genre ids
-	if len(b.GenreIDs) > 0 {
+	if err := expectOneRow(result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEditConflict
+		}
+		return dbError(err)
+	}
+	b.Version++
+	defer invalidateCatalog(ctx)
+
+	// update genres using genre ids, which clears them when there are none
+	if b.GenresSet {
 		stmt = `delete from books_genres where book_id = $1`
 		_, err := db.ExecContext(ctx, stmt, b.ID)
 		if err != nil {
-			return fmt.Errorf("book updated, but genres not: %s", err.Error())
+			return dbError(fmt.Errorf("book updated, but genres not: %w", err))
 		}
 
 		// add new genres
@@ -353,7 +398,7 @@ func (b *Book) Update() error {
 				values ($1, $2, $3, $4)`
 			_, err = db.ExecContext(ctx, stmt, b.ID, x, time.Now(), time.Now())
 			if err != nil {
-				return fmt.Errorf("book updated, but genres not: %s", err.Error())
+				return dbError(fmt.Errorf("book updated, but genres not: %w", err))
 			}
 		}
 	}
@@ -361,28 +406,240 @@ func (b *Book) Update() error {
 	return nil
 }
 
-// DeleteByID deletes a book by id
-func (b *Book) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// DeleteByID moves a book to the trash. It stays there, hidden from every other query,
+// until it is either restored or purged.
+func (b *Book) DeleteByID(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	stmt := `delete from books where id = $1`
-	_, err := db.ExecContext(ctx, stmt, id)
+	stmt := `update books set deleted_at = $1, updated_at = $1 where id = $2 and deleted_at is null`
+	result, err := db.ExecContext(ctx, stmt, time.Now(), id)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
-	return nil
+	defer invalidateCatalog(ctx)
+	return expectOneRow(result)
+}
+
+// GetDeleted returns all books in the trash, most recently deleted first
+func (b *Book) GetDeleted(ctx context.Context) ([]*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at, b.version, coalesce(b.cover_hash, ''),
+			b.deleted_at, a.id, a.author_name, a.created_at, a.updated_at
+			from books b
+			left join authors a on (b.author_id = a.id)
+			where b.deleted_at is not null
+			order by b.deleted_at desc`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var books []*Book
+
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(
+			&book.ID,
+			&book.Title,
+			&book.AuthorID,
+			&book.PublicationYear,
+			&book.Slug,
+			&book.Description,
+			&book.CreatedAt,
+			&book.UpdatedAt,
+			&book.Version,
+			&book.CoverHash,
+			&book.DeletedAt,
+			&book.Author.ID,
+			&book.Author.AuthorName,
+			&book.Author.CreatedAt,
+			&book.Author.UpdatedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+
+		books = append(books, &book)
+	}
+
+	return books, nil
+}
+
+// Restore takes a book back out of the trash
+func (b *Book) Restore(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update books set deleted_at = null, updated_at = $1 where id = $2 and deleted_at is not null`
+	result, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return dbError(err)
+	}
+	defer invalidateCatalog(ctx)
+	return expectOneRow(result)
+}
+
+// PurgeDeleted permanently deletes books which were put in the trash before cutoff,
+// along with their genre links, and returns how many books were removed
+func (b *Book) PurgeDeleted(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer tx.Rollback()
+
+	stmt := `delete from books_genres where book_id in (select id from books where deleted_at < $1)`
+	_, err = tx.ExecContext(ctx, stmt, cutoff)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	stmt = `delete from books where deleted_at < $1`
+	result, err := tx.ExecContext(ctx, stmt, cutoff)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, dbError(err)
+	}
+
+	// the purged rows were part of what the catalog state is computed from
+	if purged > 0 {
+		invalidateCatalog(ctx)
+	}
+
+	return purged, nil
+}
+
+// SetCover points a book at the cover with hash, or at no cover at all when hash is empty,
+// and returns the hash of the cover it had before
+func (b *Book) SetCover(ctx context.Context, id int, hash string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update books b set cover_hash = nullif($1, ''), updated_at = $2
+			from (select id, cover_hash from books where id = $3 for update) old
+			where b.id = old.id and b.deleted_at is null
+			returning coalesce(old.cover_hash, '')`
+
+	var previous string
+	err := db.QueryRowContext(ctx, stmt, hash, time.Now(), id).Scan(&previous)
+	if err != nil {
+		return "", dbError(err)
+	}
+	invalidateCatalog(ctx)
+
+	return previous, nil
+}
+
+// GetWithCovers returns the id, slug and cover hash of every book with a cover, including
+// those in the trash, since their covers are needed again if they are restored
+func (b *Book) GetWithCovers(ctx context.Context) ([]*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, slug, cover_hash, deleted_at from books where cover_hash is not null order by id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var books []*Book
+
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(&book.ID, &book.Slug, &book.CoverHash, &book.DeletedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+
+		books = append(books, &book)
+	}
+
+	return books, dbError(rows.Err())
+}
+
+// GetWithoutCovers returns the id and slug of every book without a cover hash, including
+// those in the trash. Covers used to be stored by slug, so these may still have one there.
+func (b *Book) GetWithoutCovers(ctx context.Context) ([]*Book, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, slug, deleted_at from books where cover_hash is null order by id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var books []*Book
+
+	for rows.Next() {
+		var book Book
+		err := rows.Scan(&book.ID, &book.Slug, &book.DeletedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+
+		books = append(books, &book)
+	}
+
+	return books, dbError(rows.Err())
+}
+
+// SetLegacyCover points a book, in the trash or not, at the cover with hash, unless it has
+// been given a cover since it was looked up. It reports whether the book was changed.
+func (b *Book) SetLegacyCover(ctx context.Context, id int, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update books set cover_hash = $1, updated_at = $2 where id = $3 and cover_hash is null`
+
+	result, err := db.ExecContext(ctx, stmt, hash, time.Now(), id)
+	if err != nil {
+		return false, dbError(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, dbError(err)
+	}
+	if rows > 0 {
+		invalidateCatalog(ctx)
+	}
+
+	return rows > 0, nil
 }
 
 // All returns a list of all authors
-func (a *Author) All() ([]*Author, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (a *Author) All(ctx context.Context) ([]*Author, error) {
+	return cached(ctx, "authors", a.all, cloneAuthors)
+}
+
+func (a *Author) all(ctx context.Context) ([]*Author, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	query := `select id, author_name, created_at, updated_at  from authors order by author_name`
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	defer rows.Close()
 	var authors []*Author
@@ -391,9 +648,91 @@ func (a *Author) All() ([]*Author, error) {
 		var author Author
 		err := rows.Scan(&author.ID, &author.AuthorName, &author.CreatedAt, &author.UpdatedAt)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 		authors = append(authors, &author)
 	}
 	return authors, nil
 }
+
+// Exists reports whether there is an author with id
+func (a *Author) Exists(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `select exists(select 1 from authors where id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return false, dbError(err)
+	}
+
+	return exists, nil
+}
+
+// All returns a list of all genres
+func (g *Genre) All(ctx context.Context) ([]*Genre, error) {
+	return cached(ctx, "genres", g.all, cloneGenres)
+}
+
+func (g *Genre) all(ctx context.Context) ([]*Genre, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, genre_name, created_at, updated_at from genres order by genre_name`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer rows.Close()
+
+	var genres []*Genre
+
+	for rows.Next() {
+		var genre Genre
+		err := rows.Scan(&genre.ID, &genre.GenreName, &genre.CreatedAt, &genre.UpdatedAt)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		genres = append(genres, &genre)
+	}
+	return genres, dbError(rows.Err())
+}
+
+// CatalogState summarizes the catalog, so clients can tell whether it changed without fetching it
+type CatalogState struct {
+	UpdatedAt time.Time // the last time a book, author, genre or genre link changed
+	Books     int
+	Authors   int
+	Genres    int
+}
+
+// CatalogState returns when the catalog last changed, and how big it is. The counts
+// catch rows which are removed without anything else being updated.
+func (b *Book) CatalogState(ctx context.Context) (*CatalogState, error) {
+	return cached(ctx, "state", b.catalogState, cloneCatalogState)
+}
+
+func (b *Book) catalogState(ctx context.Context) (*CatalogState, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select greatest(
+				(select max(updated_at) from books),
+				(select max(updated_at) from authors),
+				(select max(updated_at) from genres),
+				(select max(updated_at) from books_genres)),
+			(select count(*) from books where deleted_at is null),
+			(select count(*) from authors),
+			(select count(*) from genres)`
+
+	var state CatalogState
+	var updatedAt sql.NullTime
+
+	err := db.QueryRowContext(ctx, query).Scan(&updatedAt, &state.Books, &state.Authors, &state.Genres)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	state.UpdatedAt = updatedAt.Time
+
+	return &state, nil
+}
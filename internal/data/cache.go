@@ -0,0 +1,157 @@
+package data
+
+import (
+	"Bookstore-Backend/internal/cache"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// CacheChannel is the Postgres notification channel API instances use to tell each
+// other that the catalog changed
+const CacheChannel = "catalog_changed"
+
+var (
+	// catalogCache holds books, authors and genres as they were read from the database.
+	// It is nil, and every read goes to the database, unless ConfigureCache is called.
+	catalogCache *cache.Cache[string, interface{}]
+
+	// instanceID tells our own notifications apart from those of other instances
+	instanceID = newInstanceID()
+)
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ConfigureCache puts a cache in front of the catalog reads, holding up to size results,
+// each for up to ttl. A size or ttl of zero turns the cache off.
+func ConfigureCache(size int, ttl time.Duration) {
+	if size <= 0 || ttl <= 0 {
+		catalogCache = nil
+		return
+	}
+	catalogCache = cache.New[string, interface{}](size, ttl)
+}
+
+// CacheEnabled reports whether catalog reads are cached
+func CacheEnabled() bool {
+	return catalogCache != nil
+}
+
+// CacheStats returns the hit and miss counts of the catalog cache
+func CacheStats() cache.Stats {
+	if catalogCache == nil {
+		return cache.Stats{}
+	}
+	return catalogCache.Stats()
+}
+
+// CacheNotified handles a notification on CacheChannel. Notifications we sent ourselves
+// are ignored, since we already dropped the cache before sending them.
+func CacheNotified(payload string) {
+	if payload != instanceID {
+		purgeCatalogCache()
+	}
+}
+
+func purgeCatalogCache() {
+	if catalogCache == nil {
+		return
+	}
+	catalogCache.Purge()
+}
+
+// invalidateCatalog drops every cached catalog read after a write, both here and, through
+// Postgres, in every other instance
+func invalidateCatalog(ctx context.Context) {
+	if catalogCache == nil {
+		return
+	}
+
+	purgeCatalogCache()
+
+	// the write already happened, and other instances fall back on the ttl, so a failed
+	// notification isn't worth failing the request over
+	_, _ = db.ExecContext(ctx, `select pg_notify($1, $2)`, CacheChannel, instanceID)
+}
+
+// cached returns a copy of the value cached under key, or loads, caches and returns it.
+// Callers get copies, so nothing they change leaks into other requests.
+func cached[T any](ctx context.Context, key string, load func(context.Context) (T, error), clone func(T) T) (T, error) {
+	c := catalogCache
+	if c == nil {
+		return load(ctx)
+	}
+
+	if value, ok := c.Get(key); ok {
+		return clone(value.(T)), nil
+	}
+
+	// a write while we load purges the cache, and what we loaded may be from before it, so
+	// it is only stored if there was no purge in the meantime
+	generation := c.Generation()
+
+	value, err := load(ctx)
+	if err != nil {
+		return value, err
+	}
+
+	c.SetIfCurrent(key, value, generation)
+
+	return clone(value), nil
+}
+
+func cloneBook(book *Book) *Book {
+	c := *book
+	c.Genres = append([]Genre(nil), book.Genres...)
+	c.GenreIDs = append([]int(nil), book.GenreIDs...)
+	c.Covers = nil
+	return &c
+}
+
+func cloneBooks(books []*Book) []*Book {
+	if books == nil {
+		return nil
+	}
+
+	c := make([]*Book, len(books))
+	for i, book := range books {
+		c[i] = cloneBook(book)
+	}
+	return c
+}
+
+func cloneAuthors(authors []*Author) []*Author {
+	if authors == nil {
+		return nil
+	}
+
+	c := make([]*Author, len(authors))
+	for i, author := range authors {
+		a := *author
+		c[i] = &a
+	}
+	return c
+}
+
+func cloneGenres(genres []*Genre) []*Genre {
+	if genres == nil {
+		return nil
+	}
+
+	c := make([]*Genre, len(genres))
+	for i, genre := range genres {
+		g := *genre
+		c[i] = &g
+	}
+	return c
+}
+
+func cloneCatalogState(state *CatalogState) *CatalogState {
+	c := *state
+	return &c
+}
@@ -0,0 +1,117 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Kind is a class of error. It tells the api what went wrong without it having to know
+// about the database, and errors.Is(err, ErrNotFound) and friends work on every Error.
+type Kind string
+
+func (k Kind) Error() string {
+	return strings.ReplaceAll(string(k), "_", " ")
+}
+
+const (
+	ErrNotFound     Kind = "not_found"
+	ErrConflict     Kind = "conflict"
+	ErrValidation   Kind = "validation"
+	ErrUnauthorized Kind = "unauthorized"
+	ErrForbidden    Kind = "forbidden"
+	ErrInternal     Kind = "internal"
+)
+
+// Error is an error returned by this package. Code is stable, so clients can act on it,
+// and Message is safe to show them. Field is set when the error is about a single field.
+// The error it was made from, if any, is kept in Err for logging.
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	Field   string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match an Error against its Kind
+func (e *Error) Is(target error) bool {
+	kind, ok := target.(Kind)
+	return ok && kind == e.Kind
+}
+
+// Postgres error codes we tell apart, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+	pgNotNullViolation    = "23502"
+	pgCheckViolation      = "23514"
+	pgStringTooLong       = "22001"
+	pgNumericOutOfRange   = "22003"
+	pgInvalidText         = "22P02"
+)
+
+// dbError turns an error from the database into an Error. Errors we don't recognise are
+// internal errors, so driver messages never reach clients.
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var dataErr *Error
+	if errors.As(err, &dataErr) {
+		return err
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &Error{Kind: ErrNotFound, Code: "not_found", Message: "record not found", Err: err}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgUniqueViolation:
+			return &Error{Kind: ErrConflict, Code: "duplicate", Message: "duplicate value violates unique constraints", Err: err}
+		case pgForeignKeyViolation:
+			return &Error{Kind: ErrConflict, Code: "foreign_key_violation", Message: "the record refers to, or is referred to by, another record", Err: err}
+		case pgNotNullViolation:
+			return &Error{Kind: ErrValidation, Code: "missing_value", Message: "a required value is missing", Field: pgErr.ColumnName, Err: err}
+		case pgCheckViolation:
+			return &Error{Kind: ErrValidation, Code: "invalid_value", Message: "a value is not allowed", Err: err}
+		case pgStringTooLong, pgNumericOutOfRange:
+			return &Error{Kind: ErrValidation, Code: "value_too_large", Message: "too large value", Err: err}
+		case pgInvalidText:
+			return &Error{Kind: ErrValidation, Code: "invalid_value", Message: "a value has the wrong format", Err: err}
+		}
+	}
+
+	return internalError(err)
+}
+
+// internalError turns an error which is nobody's fault but ours into an Error, which
+// doesn't tell clients anything about it
+func internalError(err error) error {
+	return &Error{Kind: ErrInternal, Code: "internal_error", Message: "internal server error", Err: err}
+}
+
+// passwordError turns an error from hashing a password into an Error
+func passwordError(err error) error {
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return &Error{Kind: ErrValidation, Code: "password_too_long", Message: "password must be at most 72 bytes", Err: err}
+	}
+	return internalError(err)
+}
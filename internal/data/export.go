@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// exportTimeout is how long Each may take. Exports read every row, so they get far
+// longer than dbTimeout.
+var exportTimeout = 5 * time.Minute
+
+// ConfigureExports sets how long an export may take. Zero keeps the default.
+func ConfigureExports(timeout time.Duration) {
+	if timeout > 0 {
+		exportTimeout = timeout
+	}
+}
+
+// Each calls fn with every book which isn't deleted, ordered by title, as the rows are
+// read. Only one book is held at a time, so this works for catalogs of any size. The
+// book passed to fn is reused for the next row, so fn must not keep it. An error from
+// fn stops the export and is returned as it is.
+func (b *Book) Each(ctx context.Context, fn func(*Book) error) error {
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	// the genres are joined in, rather than read for each book like getAll does, since a
+	// query per row would take longer than the export itself. A book with several genres
+	// has a row for each, and they are next to each other thanks to the order by.
+	query := `select b.id, b.title, b.author_id, b.publication_year, b.slug, b.description, b.created_at, b.updated_at, b.version, coalesce(b.cover_hash, ''),
+			a.id, a.author_name, a.created_at, a.updated_at,
+			g.id, g.genre_name, g.created_at, g.updated_at
+			from books b
+			left join authors a on (b.author_id = a.id)
+			left join books_genres bg on (bg.book_id = b.id)
+			left join genres g on (bg.genre_id = g.id)
+			where b.deleted_at is null
+			order by b.title, b.id, g.genre_name`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return dbError(err)
+	}
+	defer rows.Close()
+
+	var book, row Book
+	var genreID sql.NullInt64
+	var genreName sql.NullString
+	var genreCreatedAt, genreUpdatedAt sql.NullTime
+
+	for rows.Next() {
+		err := rows.Scan(
+			&row.ID,
+			&row.Title,
+			&row.AuthorID,
+			&row.PublicationYear,
+			&row.Slug,
+			&row.Description,
+			&row.CreatedAt,
+			&row.UpdatedAt,
+			&row.Version,
+			&row.CoverHash,
+			&row.Author.ID,
+			&row.Author.AuthorName,
+			&row.Author.CreatedAt,
+			&row.Author.UpdatedAt,
+			&genreID,
+			&genreName,
+			&genreCreatedAt,
+			&genreUpdatedAt)
+		if err != nil {
+			return dbError(err)
+		}
+
+		if row.ID != book.ID {
+			if book.ID != 0 {
+				if err := fn(&book); err != nil {
+					return err
+				}
+			}
+
+			// keep the genre slices, so a new one isn't allocated for every book
+			genres, ids := book.Genres[:0], book.GenreIDs[:0]
+			book = row
+			book.Genres, book.GenreIDs, book.Covers = genres, ids, nil
+		}
+
+		if genreID.Valid {
+			book.Genres = append(book.Genres, Genre{
+				ID:        int(genreID.Int64),
+				GenreName: genreName.String,
+				CreatedAt: genreCreatedAt.Time,
+				UpdatedAt: genreUpdatedAt.Time,
+			})
+			book.GenreIDs = append(book.GenreIDs, int(genreID.Int64))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err)
+	}
+
+	if book.ID != 0 {
+		return fn(&book)
+	}
+	return nil
+}
+
+// Each calls fn with every user who isn't deleted, ordered by last name, as the rows
+// are read. Passwords are not read. Like Book.Each, the user passed to fn is reused.
+func (u *User) Each(ctx context.Context, fn func(*User) error) error {
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	query := `select id, email, first_name, last_name, user_active, created_at, updated_at, version,
+	case
+	  when exists (select 1 from tokens t where user_id = users.id and t.expiry > NOW()) then 1
+	  else 0
+	  end as has_token
+	from users where deleted_at is null order by last_name, id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return dbError(err)
+	}
+	defer rows.Close()
+
+	var user User
+	for rows.Next() {
+		user = User{}
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Active,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.Version,
+			&user.Token.ID,
+		)
+		if err != nil {
+			return dbError(err)
+		}
+
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return dbError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// SchemaVersion is the latest migration in /migrations, which this code relies on. Bump
+// it along with every new migration.
+const SchemaVersion = 7
+
+// Ping checks that the database can be reached
+func Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+// MigrationVersion returns the version of the last migration applied to the database, and
+// whether it failed half way through
+func MigrationVersion(ctx context.Context) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var version int
+	var dirty bool
+
+	err := db.QueryRowContext(ctx, `select version, dirty from schema_migrations limit 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, dbError(err)
+	}
+
+	return version, dirty, nil
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Errors returned by IdempotencyKey.Begin when a key can't be used for a request
+var (
+	ErrIdempotencyKeyReused    = &Error{Kind: ErrValidation, Code: "idempotency_key_reused", Message: "this Idempotency-Key was already used for a different request"}
+	ErrIdempotencyKeyInProcess = &Error{Kind: ErrConflict, Code: "idempotency_key_in_progress", Message: "a request with this Idempotency-Key is still being handled"}
+)
+
+// IdempotencyKey is a request sent with an Idempotency-Key header, and the response to it
+// once there is one
+type IdempotencyKey struct {
+	ID          int64
+	UserID      int
+	Key         string
+	RequestHash string // tells retries apart from different requests sent with the same key
+	Status      int    // 0 while the request is still being handled
+	Header      http.Header
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Begin claims key for a request, until expires. It returns nil when the request should go
+// ahead, and the saved response when it was already handled. Keys which have expired
+// are claimed again, as if they had never been used.
+func (k *IdempotencyKey) Begin(ctx context.Context, userID int, key, requestHash string, expires time.Time) (*IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into idempotency_keys (user_id, key, request_hash, expires_at) values ($1, $2, $3, $4)
+		on conflict (user_id, key) do update
+		set request_hash = excluded.request_hash, status = null, headers = null, body = null,
+			created_at = now(), expires_at = excluded.expires_at
+		where idempotency_keys.expires_at <= now()
+		returning id`
+
+	var id int64
+	err := db.QueryRowContext(ctx, stmt, userID, key, requestHash, expires).Scan(&id)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, dbError(err)
+	}
+
+	// the key is taken, so this is a retry, or a mistake
+	var saved IdempotencyKey
+	var status sql.NullInt32
+	var header []byte
+
+	query := `select id, user_id, key, request_hash, status, headers, body, created_at, expires_at
+		from idempotency_keys where user_id = $1 and key = $2`
+
+	err = db.QueryRowContext(ctx, query, userID, key).Scan(
+		&saved.ID,
+		&saved.UserID,
+		&saved.Key,
+		&saved.RequestHash,
+		&status,
+		&header,
+		&saved.Body,
+		&saved.CreatedAt,
+		&saved.ExpiresAt,
+	)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if saved.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !status.Valid {
+		return nil, ErrIdempotencyKeyInProcess
+	}
+
+	saved.Status = int(status.Int32)
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &saved.Header); err != nil {
+			return nil, dbError(err)
+		}
+	}
+
+	return &saved, nil
+}
+
+// Complete saves the response to the request which claimed key
+func (k *IdempotencyKey) Complete(ctx context.Context, userID int, key string, status int, header http.Header, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return dbError(err)
+	}
+
+	stmt := `update idempotency_keys set status = $1, headers = $2, body = $3 where user_id = $4 and key = $5`
+	_, err = db.ExecContext(ctx, stmt, status, h, body, userID, key)
+	return dbError(err)
+}
+
+// Release gives key up without saving a response, so the request can be tried again
+func (k *IdempotencyKey) Release(ctx context.Context, userID int, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from idempotency_keys where user_id = $1 and key = $2 and status is null`, userID, key)
+	return dbError(err)
+}
+
+// PurgeExpired deletes the keys which have expired, and returns how many there were
+func (k *IdempotencyKey) PurgeExpired(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `delete from idempotency_keys where expires_at <= now()`)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	n, err := res.RowsAffected()
+	return n, dbError(err)
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"Bookstore-Backend/internal/validator"
 	"context"
 	"crypto/sha256"
 	"database/sql"
@@ -16,6 +17,18 @@ import (
 
 const dbTimeout = time.Second * 3 // If db access takes longer than 3 seconds, cancel it
 
+// ErrEditConflict is returned when a row was changed by someone else since it was read
+var ErrEditConflict = &Error{Kind: ErrConflict, Code: "edit_conflict", Message: "edit conflict: this record was changed by someone else"}
+
+// Errors returned when a token doesn't authenticate anyone, so callers can tell why
+var (
+	ErrTokenMissing   = &Error{Kind: ErrUnauthorized, Code: "token_missing", Message: "no authorization header received"}
+	ErrTokenMalformed = &Error{Kind: ErrUnauthorized, Code: "token_malformed", Message: "no valid authorization header received"}
+	ErrTokenNotFound  = &Error{Kind: ErrUnauthorized, Code: "token_not_found", Message: "no matching token found"}
+	ErrTokenExpired   = &Error{Kind: ErrUnauthorized, Code: "token_expired", Message: "expired token"}
+	ErrUserInactive   = &Error{Kind: ErrUnauthorized, Code: "user_inactive", Message: "user is not active"}
+)
+
 var db *sql.DB
 
 func New(dbPool *sql.DB) Models {
@@ -26,6 +39,9 @@ func New(dbPool *sql.DB) Models {
 		Token: Token{},
 		Book: Book{},
 		Author: Author{},
+		Genre: Genre{},
+		AuditLog: AuditLog{},
+		IdempotencyKey: IdempotencyKey{},
 	}
 }
 
@@ -34,34 +50,44 @@ type Models struct {
 	Token Token
 	Book Book
 	Author Author
+	Genre Genre
+	AuditLog AuditLog
+	IdempotencyKey IdempotencyKey
 }
 
 type User struct {
 	ID        int       `json:"id"`
-	Email     string    `json:"email"`
-	FirstName string    `json:"first_name,omitempty"`
-	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"password"`
-	Active    int       `json:"active"`
+	Email     string    `json:"email" validate:"required,email,max=255"`
+	FirstName string    `json:"first_name,omitempty" validate:"max=255"`
+	LastName  string    `json:"last_name,omitempty" validate:"max=255"`
+	Password  string    `json:"password" validate:"max=72"`
+	Active    int       `json:"active" validate:"oneof=0 1"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Token     Token     `json:"token"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Version   int       `json:"version"`
+}
+
+// Validate checks the rules for users which can't be put in tags
+func (u User) Validate(v *validator.Validator) {
+	v.Check(u.ID != 0 || u.Password != "", "password", "required", "must be given for new users")
 }
 
-func (u *User) GetAll() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) GetAll(ctx context.Context) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at,
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, version,
 	case
 	  when (select count(id) from tokens t where user_id = users.id and t.expiry > NOW()) > 0 then 1
 	  else 0
 	  end as has_token
-	from users order by last_name`
+	from users where deleted_at is null order by last_name`
 
 	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 
 	defer rows.Close()
@@ -76,13 +102,14 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.FirstName,
 			&user.LastName,
 			&user.Password,
-			&user.CreatedAt,
 			&user.Active,
+			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.Version,
 			&user.Token.ID,	
 		)
 		if err != nil {
-			return nil, err
+			return nil, dbError(err)
 		}
 
 		users = append(users, &user)
@@ -90,11 +117,11 @@ func (u *User) GetAll() ([]*User, error) {
 	return users, nil
 }
 
-func (u *User) GetByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) GetByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, version from users where email = $1 and deleted_at is null`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, email)
@@ -108,20 +135,21 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	return &user, nil
 }
 
 // Returns one user by id
 
-func (u *User) GetOne(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) GetOne(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, version from users where id = $1 and deleted_at is null`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, id)
@@ -135,15 +163,18 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	return &user, nil
 }
 
-func (u *User) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Update saves the user, as long as it is still at u.Version. If someone else
+// saved the user in the meantime, ErrEditConflict is returned.
+func (u *User) Update(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	// statement, because it's not query
@@ -151,67 +182,164 @@ func (u *User) Update() error {
 	email = $1,
 	first_name = $2,
     last_name = $3,
-	user_active = $4
+	user_active = $4,
 	updated_at = $5,
-	where id = $6 
+	version = version + 1
+	where id = $6 and version = $7 and deleted_at is null
 
 	`
 
-	_, err := db.ExecContext(ctx, stmt,
+	result, err := db.ExecContext(ctx, stmt,
 		u.Email,
 		u.FirstName,
 		u.LastName,
 		u.Active,
 		time.Now(),
 		u.ID,
+		u.Version,
 	)
 
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
+	if err := expectOneRow(result); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEditConflict
+		}
+		return dbError(err)
+	}
+
+	u.Version++
 	return nil
 }
 
-func (u *User) Delete() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (u *User) Delete(ctx context.Context) error {
+	return u.DeleteById(ctx, u.ID)
+}
+
+// DeleteById moves a user to the trash, and logs them out. They can't log in
+// again until they are restored.
+func (u *User) DeleteById(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	stmt := `update users set deleted_at = $1, updated_at = $1 where id = $2 and deleted_at is null`
 
-	_, err := db.ExecContext(ctx, stmt, u.ID)
+	result, err := db.ExecContext(ctx, stmt, time.Now(), id)
 	if err != nil {
-		return err
+		return dbError(err)
+	}
+
+	if err := expectOneRow(result); err != nil {
+		return dbError(err)
+	}
+
+	stmt = `delete from tokens where user_id = $1`
+	_, err = db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return dbError(err)
 	}
 
 	return nil
 
 }
 
-func (u *User) DeleteById(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetDeleted returns all users in the trash, most recently deleted first
+func (u *User) GetDeleted(ctx context.Context) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	query := `select id, email, first_name, last_name, user_active, created_at, updated_at, deleted_at
+	from users where deleted_at is not null order by deleted_at desc`
 
-	_, err := db.ExecContext(ctx, stmt, id)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return err
+		return nil, dbError(err)
 	}
 
-	return nil
+	defer rows.Close()
+
+	var users []*User
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Active,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.DeletedAt,
+		)
+		if err != nil {
+			return nil, dbError(err)
+		}
 
+		users = append(users, &user)
+	}
+	return users, nil
 }
 
-func (u *User) Insert(user User) (int, error) { // because we return a id
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// Restore takes a user back out of the trash
+func (u *User) Restore(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
+	stmt := `update users set deleted_at = null, updated_at = $1 where id = $2 and deleted_at is not null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return dbError(err)
+	}
+
+	return expectOneRow(result)
+}
+
+// PurgeDeleted permanently deletes users who were put in the trash before cutoff,
+// and returns how many were removed
+func (u *User) PurgeDeleted(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	defer tx.Rollback()
+
+	stmt := `delete from tokens where user_id in (select id from users where deleted_at < $1)`
+	_, err = tx.ExecContext(ctx, stmt, cutoff)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	stmt = `delete from users where deleted_at < $1`
+	result, err := tx.ExecContext(ctx, stmt, cutoff)
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, dbError(err)
+	}
+
+	return purged, dbError(tx.Commit())
+}
+
+func (u *User) Insert(ctx context.Context, user User) (int, error) { // because we return a id
+	// hash before the timeout starts, bcrypt takes a good part of dbTimeout on its own
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12) // default is 10, but used 12 for hash.
 	if err != nil {
-		return 0, err
+		return 0, passwordError(err)
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
 	// If that pass that.
 
 	var newID int
@@ -232,26 +360,26 @@ func (u *User) Insert(user User) (int, error) { // because we return a id
 	).Scan(&newID)
 
 	if err != nil {
-		return 0, err
+		return 0, dbError(err)
 	}
 	return newID, nil
 
 }
 
-func (u *User) ResetPassword(password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
+func (u *User) ResetPassword(ctx context.Context, password string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12) // default is 10, but used 12 for hash.
 	if err != nil {
-		return err
+		return passwordError(err)
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
 	stmt := `update users set password = $1 where id =$2`
 
 	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 	return nil
 }
@@ -271,6 +399,19 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 	return true, nil
 }
 
+// expectOneRow turns an update or delete which didn't touch any rows into ErrNotFound
+func expectOneRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return dbError(err)
+	}
+
+	if n == 0 {
+		return dbError(sql.ErrNoRows)
+	}
+	return nil
+}
+
 type Token struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"user_id"`
@@ -282,8 +423,8 @@ type Token struct {
 	Expiry    time.Time `json:"expiry"`
 }
 
-func (t *Token) GetByToken(plainText string) (*Token, error) { // we return actual token from db
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (t *Token) GetByToken(ctx context.Context, plainText string) (*Token, error) { // we return actual token from db
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	query := `select id, user_id, email, token, token_hash, created_at, updated_at, expiry
@@ -305,18 +446,18 @@ func (t *Token) GetByToken(plainText string) (*Token, error) { // we return actu
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 
 	return &token, nil
 
 }
 
-func (t *Token) GetUserForToken(token Token) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (t *Token) GetUserForToken(ctx context.Context, token Token) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, user_active, created_at, updated_at, version from users where id = $1 and deleted_at is null`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, token.UserID)
@@ -330,10 +471,11 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 		&user.Active,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Version,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
 	return &user, nil
 
@@ -351,7 +493,7 @@ func (t *Token) GenerateToken(UserID int, ttl time.Duration) (*Token, error) { /
 	_, err := rand.Read(randomBytes)
 
 	if err != nil {
-		return nil, err
+		return nil, internalError(err)
 	}
 
 	// if we pass the error
@@ -370,52 +512,52 @@ func (t *Token) AuthenticateToken(r *http.Request) (*User, error) {
 	// get the authorization header
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header received") // if there is no user
+		return nil, ErrTokenMissing // if there is no user
 	}
     
 	// get the plain text token from the header
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no valid authorization header received")
+		return nil, ErrTokenMalformed
 	}
 
 	token := headerParts[1]
     // make sure the token is of the correct length
 	if len(token) != 26 {
-		return nil, errors.New("token wrong size")
+		return nil, ErrTokenMalformed
 	}
 
-	tkn, err := t.GetByToken(token) // get the token from db
+	tkn, err := t.GetByToken(r.Context(), token) // get the token from db
 	if err != nil {
-		return nil, errors.New("no matching token found")
+		return nil, ErrTokenNotFound
 	}
 
 	if tkn.Expiry.Before(time.Now()) {
-		return nil, errors.New("Expired Token")
+		return nil, ErrTokenExpired
 	}
 
-	user, err := t.GetUserForToken(*tkn)
+	user, err := t.GetUserForToken(r.Context(), *tkn)
 	if err != nil {
-		return nil, errors.New("no matching user found")
+		return nil, ErrTokenNotFound
 	}
 
 	if user.Active == 0 {
-		return nil, errors.New("user is not active")
+		return nil, ErrUserInactive
 	}
 
 	return user, nil
 
 }
 
-func (t *Token) Insert(token Token, u User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (t *Token) Insert(ctx context.Context, token Token, u User) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	// delete existing tokens
 	stmt := `delete	from tokens where user_id = $1`
 	_, err := db.ExecContext(ctx, stmt, token.UserID)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
 	token.Email = u.Email
@@ -435,15 +577,15 @@ func (t *Token) Insert(token Token, u User) error {
 	)
 
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 
 	return nil
 
 }
 
-func (t *Token) DeleteByToken(plainText string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (t *Token) DeleteByToken(ctx context.Context, plainText string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `delete from tokens where token = $1`
@@ -451,40 +593,40 @@ func (t *Token) DeleteByToken(plainText string) error {
 	_, err := db.ExecContext(ctx, stmt, plainText)
 
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 	return nil
 }
 
-func (t *Token) DeleteTokensForuser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (t *Token) DeleteTokensForuser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `delete from tokens where user_id = $1`
 	_, err := db.ExecContext(ctx, stmt, id)
 	if err != nil {
-		return err
+		return dbError(err)
 	}
 	return nil
 }
 
 // That makes certain about a given token is valid
 
-func (t *Token) ValidToken(plainText string) (bool, error) { // bool if token is valid or not
+func (t *Token) ValidToken(ctx context.Context, plainText string) (bool, error) { // bool if token is valid or not
 
-	token, err := t.GetByToken(plainText)
+	token, err := t.GetByToken(ctx, plainText)
 	if err != nil {
-		return false, errors.New("no matching token find")
+		return false, ErrTokenNotFound
 	}
 
 	// checking the if user exist
-	_, err = t.GetUserForToken(*token)
+	_, err = t.GetUserForToken(ctx, *token)
 	if err != nil {
-		return false, errors.New("no matching user find")
+		return false, ErrTokenNotFound
 	}
 	// checking the if token expiry
 	if token.Expiry.Before(time.Now()) {
-		return false, errors.New("expired token")
+		return false, ErrTokenExpired
 	}
 
 	return true, nil
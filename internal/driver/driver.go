@@ -1,12 +1,14 @@
 package driver
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log/slog"
 	"time"
 	_ "github.com/jackc/pgconn"
-	_ "github.com/jackc/pgx/v4"
-	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
 )
 
 type DB struct{
@@ -20,11 +22,15 @@ const maxIdleDbConn = 5 // When the task is complete the connection is marked as
 const maxDbLifeTime = 5 * time.Minute // How long should they stay open
 
 
-func ConnectPostgres(dsn string) (*DB, error) { // dsn = data source name, it'll return db and potentially error
-	d, err := sql.Open("pgx", dsn) // dsn is connection string up here
+func ConnectPostgres(dsn string, logger *slog.Logger) (*DB, error) { // dsn = data source name, it'll return db and potentially error
+	config, err := pgx.ParseConfig(dsn) // dsn is connection string up here
 	if err != nil{
 		return nil, err
 	}
+	config.Logger = queryLogger{logger}
+	config.LogLevel = pgxLogLevel(logger)
+
+	d := stdlib.OpenDB(*config)
 
 	d.SetMaxOpenConns(maxOpenDbConn)
 	d.SetMaxIdleConns(maxIdleDbConn)
@@ -39,13 +45,16 @@ func ConnectPostgres(dsn string) (*DB, error) { // dsn = data source name, it'll
 	return dbConn, nil
 }  
 
+// testDB makes sure the database can actually be reached, rather than finding out with
+// the first request
 func testDB(d *sql.DB) error{
-	err := d.Ping()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := d.PingContext(ctx)
 	if err != nil{
-		fmt.Print("Error!", err)
-		return err
-	} 
-		fmt.Println("*** Pinged database succesfully ***")
+		return fmt.Errorf("cannot ping database: %w", err)
+	}
 
 	return nil
-	}
\ No newline at end of file
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	minListenBackoff = time.Second
+	maxListenBackoff = 30 * time.Second
+)
+
+// Listen calls notify with the payload of every notification sent on channel, until ctx
+// is done. It uses a connection of its own, so it never holds on to one from the pool.
+// Lost connections are reopened, and since notifications may have been missed in the
+// meantime, notify is called with an empty payload after every reconnect.
+func Listen(ctx context.Context, dsn, channel string, notify func(payload string), logger *slog.Logger) {
+	backoff := minListenBackoff
+	connected := false
+
+	for ctx.Err() == nil {
+		err := listen(ctx, dsn, channel, notify, func() {
+			backoff = minListenBackoff
+			if connected {
+				notify("")
+			}
+			connected = true
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Error("lost listener, retrying", "channel", channel, "backoff", backoff, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxListenBackoff {
+			backoff = maxListenBackoff
+		}
+	}
+}
+
+// listen runs one connection until it fails, calling ready once it is listening
+func listen(ctx context.Context, dsn, channel string, notify func(string), ready func()) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	ready()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		notify(notification.Payload)
+	}
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// queryLogger writes what pgx logs about queries to our own logger. pgx hands us the
+// context of the query, so the lines carry the id of the request that ran it.
+type queryLogger struct {
+	logger *slog.Logger
+}
+
+func (l queryLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	var slogLevel slog.Level
+	switch {
+	case level >= pgx.LogLevelDebug:
+		slogLevel = slog.LevelDebug - 4
+	case level >= pgx.LogLevelInfo:
+		slogLevel = slog.LevelDebug
+	case level >= pgx.LogLevelWarn:
+		slogLevel = slog.LevelWarn
+	default:
+		slogLevel = slog.LevelError
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		// the arguments of a query are passwords and tokens as often as not
+		if key != "args" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.Any(key, data[key]))
+	}
+
+	l.logger.LogAttrs(ctx, slogLevel, "db: "+msg, attrs...)
+}
+
+// pgxLogLevel is how much pgx should tell us about. Every query is only logged when
+// debugging, otherwise just the ones that fail.
+func pgxLogLevel(logger *slog.Logger) pgx.LogLevel {
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		return pgx.LogLevelInfo
+	}
+	return pgx.LogLevelError
+}
@@ -0,0 +1,123 @@
+// Package logging sets up the structured logs of the api, and keeps secrets out of them.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Redacted replaces the value of every sensitive attribute
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are parts of attribute names whose values never make it into a log
+var sensitiveKeys = []string{"password", "token", "secret", "authorization", "cookie", "code_verifier"}
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// WithRequestID returns a copy of ctx carrying the id of the request it belongs to
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the id of the request ctx belongs to, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ParseLevel turns a level name like "debug" or "warn" into a level
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+// New returns a logger writing JSON lines to w, for records at level and above. Records
+// logged with a context carry the id of the request, and sensitive attributes are redacted.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: redact})
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request id from the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact blanks out sensitive attributes. Structs, maps and slices are looked into as
+// well, the way they would be written as JSON, so logging a whole user can't leak their
+// password hash.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if sensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+
+	if a.Value.Kind() != slog.KindAny {
+		return a
+	}
+
+	switch a.Value.Any().(type) {
+	case error, json.Marshaler:
+		return a
+	}
+
+	b, err := json.Marshal(a.Value.Any())
+	if err != nil {
+		return a
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return a
+	}
+
+	return slog.Any(a.Key, redactValue(v))
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitive(key) {
+				v[key] = Redacted
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
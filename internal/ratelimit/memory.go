@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often Memory drops the buckets of clients which have gone away
+const sweepInterval = time.Minute
+
+// Memory keeps buckets in memory, so each instance of the api counts on its own. It is
+// safe for concurrent use.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]memoryBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	full time.Time // when the bucket is full again, and can be forgotten
+}
+
+// NewMemory returns a Memory without any buckets
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: make(map[string]memoryBucket),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, result := take(m.buckets[key].bucket, limit, now)
+	m.buckets[key] = memoryBucket{bucket: b, full: now.Add(result.Reset)}
+
+	return result, nil
+}
+
+// Len returns how many buckets are kept
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.buckets)
+}
+
+// sweep drops full buckets, since a missing bucket counts as a full one anyway
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Postgres keeps buckets in the rate_limits table, so every instance of the api shares them
+type Postgres struct {
+	db *sql.DB
+}
+
+// NewPostgres returns a Postgres which keeps buckets in db
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{db: db}
+}
+
+func (p *Postgres) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// the database's clock is used, so instances with skewed clocks still agree
+	var now time.Time
+	if err := tx.QueryRowContext(ctx, `select now()`).Scan(&now); err != nil {
+		return Result{}, err
+	}
+
+	// a new client gets a full bucket first, so there is always a row to lock. When two of
+	// its first requests race, the second insert waits for the first and does nothing.
+	stmt := `insert into rate_limits (key, tokens, updated_at, expires_at) values ($1, $2, $3, $3)
+		on conflict (key) do nothing`
+	if _, err := tx.ExecContext(ctx, stmt, key, float64(limit.Requests), now); err != nil {
+		return Result{}, err
+	}
+
+	// the row is locked until we commit, so requests from the same client take turns
+	var b bucket
+	err = tx.QueryRowContext(ctx, `select tokens, updated_at from rate_limits where key = $1 for update`, key).Scan(&b.tokens, &b.updated)
+	if err != nil {
+		return Result{}, err
+	}
+
+	b, result := take(b, limit, now)
+
+	stmt = `update rate_limits set tokens = $2, updated_at = $3, expires_at = $4 where key = $1`
+	if _, err := tx.ExecContext(ctx, stmt, key, b.tokens, b.updated, now.Add(result.Reset)); err != nil {
+		return Result{}, err
+	}
+
+	return result, tx.Commit()
+}
+
+// Purge deletes the buckets which are full again, since a missing bucket counts as a full one
+func (p *Postgres) Purge(ctx context.Context) (int64, error) {
+	res, err := p.db.ExecContext(ctx, `delete from rate_limits where expires_at <= now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,117 @@
+// Package ratelimit limits how often clients can make requests, with a token bucket for
+// each client. A bucket holds up to Limit.Requests tokens and is refilled evenly over
+// Limit.Window, so clients can burst up to the limit and then carry on at its rate.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is how many requests a client can make in a window
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// Enabled reports whether l limits anything. The zero Limit doesn't.
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Window > 0
+}
+
+// String formats l the way ParseLimit reads it
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return strconv.Itoa(l.Requests) + "/" + l.Window.String()
+}
+
+// rate is how many tokens are added to a bucket per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+// ParseLimit reads a limit written as requests/window, like "10/1m". "off" and "0" turn
+// limiting off.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+
+	requests, window, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("limit %q is not requests/window, like 10/1m", s)
+	}
+
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("limit %q: requests must be a positive number", s)
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("limit %q: window must be a positive duration", s)
+	}
+
+	return Limit{Requests: n, Window: d}, nil
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int           // whole tokens left in the bucket
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until a token is available, zero when Allowed
+}
+
+// Store keeps the buckets. Take takes a token from the bucket for key, creating a full
+// one if there isn't one yet.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// bucket is the state of one client's bucket
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills b for the time since it was last updated, and then takes a token from it
+// if there is one. It is shared by the stores, so they all count the same way.
+func take(b bucket, limit Limit, now time.Time) (bucket, Result) {
+	capacity := float64(limit.Requests)
+	rate := limit.rate()
+
+	tokens := capacity
+	if !b.updated.IsZero() {
+		elapsed := now.Sub(b.updated).Seconds()
+		if elapsed < 0 {
+			elapsed = 0 // clocks of different instances disagree
+		}
+		tokens = math.Min(capacity, b.tokens+elapsed*rate)
+	}
+
+	result := Result{Limit: limit.Requests}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - tokens) / rate)
+	}
+
+	result.Remaining = int(tokens)
+	result.Reset = seconds((capacity - tokens) / rate)
+
+	return bucket{tokens: tokens, updated: now}, result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestParseLimit(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected Limit
+		wantErr  bool
+	}{
+		{"10/1m", Limit{10, time.Minute}, false},
+		{" 5/30s ", Limit{5, 30 * time.Second}, false},
+		{"off", Limit{}, false},
+		{"0", Limit{}, false},
+		{"10", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"10/soon", Limit{}, true},
+		{"10/0s", Limit{}, true},
+	}
+
+	for _, e := range tests {
+		got, err := ParseLimit(e.in)
+		if (err != nil) != e.wantErr {
+			t.Errorf("%q: unexpected error %v", e.in, err)
+			continue
+		}
+		if got != e.expected {
+			t.Errorf("%q: expected %v but got %v", e.in, e.expected, got)
+		}
+	}
+}
+
+func TestMemory_Take(t *testing.T) {
+	now := time.Now()
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	limit := Limit{Requests: 3, Window: 3 * time.Second} // a token a second
+
+	for i := 2; i >= 0; i-- {
+		result, _ := m.Take(context.Background(), "a", limit)
+		if !result.Allowed || result.Remaining != i {
+			t.Fatalf("expected to be allowed with %d left, got %+v", i, result)
+		}
+	}
+
+	result, _ := m.Take(context.Background(), "a", limit)
+	if result.Allowed {
+		t.Fatal("expected the fourth request to be turned away")
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("expected to retry after a second, got %s", result.RetryAfter)
+	}
+	if result.Reset != 3*time.Second {
+		t.Errorf("expected the bucket to be full in 3s, got %s", result.Reset)
+	}
+
+	// other clients have their own buckets
+	if result, _ := m.Take(context.Background(), "b", limit); !result.Allowed {
+		t.Error("expected another client to be allowed")
+	}
+
+	now = now.Add(time.Second)
+	if result, _ := m.Take(context.Background(), "a", limit); !result.Allowed {
+		t.Error("expected a token to be back after a second")
+	}
+}
+
+func TestMemory_Sweep(t *testing.T) {
+	now := time.Now()
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	limit := Limit{Requests: 10, Window: time.Second}
+	_, _ = m.Take(context.Background(), "a", limit)
+	_, _ = m.Take(context.Background(), "b", limit)
+
+	now = now.Add(sweepInterval)
+	_, _ = m.Take(context.Background(), "c", limit)
+
+	if m.Len() != 1 {
+		t.Errorf("expected the full buckets to be dropped, %d are left", m.Len())
+	}
+}
+
+func TestPostgres_Take(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	limit := Limit{Requests: 10, Window: 10 * time.Second}
+
+	// a token was taken 2s ago, and two have come back since
+	mock.ExpectBegin()
+	mock.ExpectQuery("select now").WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(now))
+	mock.ExpectExec("insert into rate_limits .* on conflict \\(key\\) do nothing").WithArgs("ip:192.0.2.1", 10.0, now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select tokens, updated_at from rate_limits .* for update").WithArgs("ip:192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "updated_at"}).AddRow(5.0, now.Add(-2*time.Second)))
+	mock.ExpectExec("update rate_limits").WithArgs("ip:192.0.2.1", 6.0, now, now.Add(4*time.Second)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	result, err := NewPostgres(db).Take(context.Background(), "ip:192.0.2.1", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Remaining != 6 {
+		t.Errorf("expected to be allowed with 6 left, got %+v", result)
+	}
+
+	// a new client's full bucket is inserted first, and then locked like any other
+	mock.ExpectBegin()
+	mock.ExpectQuery("select now").WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(now))
+	mock.ExpectExec("insert into rate_limits .* on conflict \\(key\\) do nothing").WithArgs("ip:192.0.2.2", 10.0, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("select tokens, updated_at from rate_limits .* for update").WithArgs("ip:192.0.2.2").
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "updated_at"}).AddRow(10.0, now))
+	mock.ExpectExec("update rate_limits").WithArgs("ip:192.0.2.2", 9.0, now, now.Add(time.Second)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	result, err = NewPostgres(db).Take(context.Background(), "ip:192.0.2.2", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Remaining != 9 {
+		t.Errorf("expected a new client to be allowed with 9 left, got %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
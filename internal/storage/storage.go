@@ -0,0 +1,48 @@
+// Package storage holds the places we can keep blobs, like book covers, in.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when there is no blob for a key
+var ErrNotFound = errors.New("blob not found")
+
+// Blob describes one stored blob
+type Blob struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores blobs under slash separated keys, like "covers/it-small.jpg"
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing anything already there
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get returns the content of the blob for key, returning ErrNotFound if there isn't
+	// one. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the blob for key, returning ErrNotFound if there isn't one
+	Delete(ctx context.Context, key string) error
+
+	// Exists reports whether there is a blob for key
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// List returns every blob whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]Blob, error)
+
+	// URL returns the url clients can download the blob for key from
+	URL(key string) string
+}
+
+// ExpiringURLs is implemented by stores whose urls only work for a while. The urls of a
+// store stay the same until the window URLWindow returns moves on, so whatever keeps them,
+// like a client caching a catalog response, can tell when they are replaced.
+type ExpiringURLs interface {
+	URLWindow() time.Time
+}
@@ -0,0 +1,251 @@
+// Package validator checks request payloads against rules declared in struct tags, and
+// collects every problem found so they can all be reported at once.
+//
+// Rules are given in a validate tag, separated by commas:
+//
+//	Title string `json:"title" validate:"required,max=255"`
+//
+// The rules are
+//
+//	required   the value is not the zero value, or for strings not just whitespace
+//	min=N      numbers are at least N, strings and slices have at least N characters or items
+//	max=N      numbers are at most N, strings and slices have at most N characters or items
+//	email      the value is a plain email address
+//	oneof=A B  the value is one of the values separated by spaces
+//
+// Rules other than required are only checked on values which are set, so optional fields
+// can have rules too. Fields are reported by their json name. Rules which need more than
+// one field go in a Validate method, see Validatable.
+package validator
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// FieldError is a problem with one field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"` // the rule which failed, like "required"
+	Message string `json:"message"`
+}
+
+// Errors are the problems found with a payload
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, f := range e {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validatable is implemented by payloads with rules which can't be put in tags. Validate
+// is called after the tags have been checked.
+type Validatable interface {
+	Validate(v *Validator)
+}
+
+// Validator collects problems with a payload
+type Validator struct {
+	errors Errors
+}
+
+// New returns a Validator without any problems yet
+func New() *Validator {
+	return &Validator{}
+}
+
+// Validate checks s, which is a struct or a pointer to one, and returns Errors if there
+// is anything wrong with it
+func Validate(s interface{}) error {
+	v := New()
+	v.Struct(s)
+	return v.Err()
+}
+
+// Add records a problem with field
+func (v *Validator) Add(field, code, message string) {
+	v.errors = append(v.errors, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Check records a problem with field unless ok
+func (v *Validator) Check(ok bool, field, code, message string) {
+	if !ok {
+		v.Add(field, code, message)
+	}
+}
+
+// HasError reports whether a problem has already been recorded for field, so further
+// checks of it can be skipped
+func (v *Validator) HasError(field string) bool {
+	for _, e := range v.errors {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid reports whether no problems have been found
+func (v *Validator) Valid() bool {
+	return len(v.errors) == 0
+}
+
+// Err returns the problems found, or nil when there are none
+func (v *Validator) Err() error {
+	if v.Valid() {
+		return nil
+	}
+	return v.errors
+}
+
+// Struct checks the tags of s, which is a struct or a pointer to one, and then calls its
+// Validate method if it has one
+func (v *Validator) Struct(s interface{}) {
+	value := reflect.Indirect(reflect.ValueOf(s))
+	if value.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validator: %T is not a struct", s))
+	}
+
+	for _, f := range fieldsOf(value.Type()) {
+		field := value.FieldByIndex(f.index)
+		for _, r := range f.rules {
+			if r.name != "required" && field.IsZero() {
+				continue
+			}
+			if message, ok := r.check(field); !ok {
+				v.Add(f.name, r.name, message)
+				break // one problem per field is enough
+			}
+		}
+	}
+
+	if validatable, ok := s.(Validatable); ok {
+		validatable.Validate(v)
+	}
+}
+
+// field is a struct field with rules
+type field struct {
+	name  string
+	index []int
+	rules []rule
+}
+
+type rule struct {
+	name  string
+	check func(reflect.Value) (string, bool)
+}
+
+// fieldCache holds the fields of the types seen so far, since tags never change
+var fieldCache sync.Map // reflect.Type -> []field
+
+func fieldsOf(t reflect.Type) []field {
+	if cached, ok := fieldCache.Load(t); ok {
+		return cached.([]field)
+	}
+
+	var fields []field
+	for _, sf := range reflect.VisibleFields(t) {
+		tag, ok := sf.Tag.Lookup("validate")
+		if !ok || !sf.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if name == "" {
+			name = sf.Name
+		}
+
+		f := field{name: name, index: sf.Index}
+		for _, spec := range strings.Split(tag, ",") {
+			f.rules = append(f.rules, parseRule(t, sf, strings.TrimSpace(spec)))
+		}
+		fields = append(fields, f)
+	}
+
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// parseRule turns one rule of a tag into a check. Mistakes in tags are bugs, so they panic.
+func parseRule(t reflect.Type, sf reflect.StructField, spec string) rule {
+	name, arg, _ := strings.Cut(spec, "=")
+	bad := func(reason string) {
+		panic(fmt.Sprintf("validator: %s.%s: rule %q %s", t.Name(), sf.Name, spec, reason))
+	}
+
+	switch name {
+	case "required":
+		return rule{name, func(v reflect.Value) (string, bool) {
+			if v.Kind() == reflect.String {
+				return "must be given", strings.TrimSpace(v.String()) != ""
+			}
+			return "must be given", !v.IsZero()
+		}}
+
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			bad("needs a number")
+		}
+		return rule{name, func(v reflect.Value) (string, bool) {
+			size, unit := measure(v)
+			if name == "min" {
+				return fmt.Sprintf("must be at least %s%s", arg, unit), size >= n
+			}
+			return fmt.Sprintf("must be at most %s%s", arg, unit), size <= n
+		}}
+
+	case "email":
+		if sf.Type.Kind() != reflect.String {
+			bad("only applies to strings")
+		}
+		return rule{name, func(v reflect.Value) (string, bool) {
+			addr, err := mail.ParseAddress(v.String())
+			return "must be a valid email address", err == nil && addr.Address == v.String()
+		}}
+
+	case "oneof":
+		allowed := strings.Fields(arg)
+		if len(allowed) == 0 {
+			bad("needs values")
+		}
+		return rule{name, func(v reflect.Value) (string, bool) {
+			value := fmt.Sprint(v.Interface())
+			for _, a := range allowed {
+				if value == a {
+					return "", true
+				}
+			}
+			return "must be one of " + strings.Join(allowed, ", "), false
+		}}
+	}
+
+	bad("is unknown")
+	return rule{}
+}
+
+// measure returns what min and max compare against: the value of numbers, and the length
+// of everything else, with the unit to mention in messages
+func measure(v reflect.Value) (float64, string) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), ""
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters"
+	default:
+		return float64(v.Len()), " items"
+	}
+}
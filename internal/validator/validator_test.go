@@ -0,0 +1,106 @@
+package validator
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type base struct {
+	ID int `json:"id" validate:"min=0"`
+}
+
+type payload struct {
+	base
+	Title  string   `json:"title" validate:"required,max=5"`
+	Email  string   `json:"email,omitempty" validate:"email"`
+	Year   int      `json:"year" validate:"required,min=1,max=2000"`
+	State  string   `json:"state" validate:"oneof=open closed"`
+	Active int      `json:"active" validate:"oneof=0 1"`
+	Tags   []string `json:"tags" validate:"max=2"`
+	Note   string   `validate:"max=3"`
+	Other  string   `json:"other"`
+}
+
+// Validate makes a title of "admin" need an email
+func (p payload) Validate(v *Validator) {
+	v.Check(p.Title != "admin" || p.Email != "", "email", "required", "must be given for admins")
+}
+
+func TestValidate(t *testing.T) {
+	valid := payload{Title: "It", Year: 1986}
+
+	var tests = []struct {
+		name   string
+		change func(p *payload)
+		want   Errors
+	}{
+		{"valid", func(p *payload) {}, nil},
+		{"everything set", func(p *payload) {
+			p.ID, p.Email, p.State, p.Active, p.Tags, p.Note = 3, "me@example.com", "open", 1, []string{"a"}, "abc"
+		}, nil},
+		{"missing", func(p *payload) { p.Title, p.Year = " ", 0 }, Errors{
+			{"title", "required", "must be given"},
+			{"year", "required", "must be given"},
+		}},
+		{"too long", func(p *payload) { p.Title, p.Note = "Ulysses", "long" }, Errors{
+			{"title", "max", "must be at most 5 characters"},
+			{"Note", "max", "must be at most 3 characters"},
+		}},
+		{"multibyte", func(p *payload) { p.Title = "Šøgnë" }, nil},
+		{"out of range", func(p *payload) { p.Year, p.ID = 2001, -1 }, Errors{
+			{"id", "min", "must be at least 0"},
+			{"year", "max", "must be at most 2000"},
+		}},
+		{"bad email", func(p *payload) { p.Email = "Me <me@example.com>" }, Errors{
+			{"email", "email", "must be a valid email address"},
+		}},
+		{"not one of", func(p *payload) { p.State, p.Active = "ajar", 2 }, Errors{
+			{"state", "oneof", "must be one of open, closed"},
+			{"active", "oneof", "must be one of 0, 1"},
+		}},
+		{"too many items", func(p *payload) { p.Tags = []string{"a", "b", "c"} }, Errors{
+			{"tags", "max", "must be at most 2 items"},
+		}},
+		{"Validate method", func(p *payload) { p.Title = "admin" }, Errors{
+			{"email", "required", "must be given for admins"},
+		}},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			p := valid
+			e.change(&p)
+
+			err := Validate(&p)
+			if e.want == nil {
+				if err != nil {
+					t.Fatalf("expected no errors, got %v", err)
+				}
+				return
+			}
+
+			var got Errors
+			if !errors.As(err, &got) {
+				t.Fatalf("expected Errors, got %v", err)
+			}
+			if !reflect.DeepEqual(got, e.want) {
+				t.Errorf("got %+v\nwant %+v", got, e.want)
+			}
+		})
+	}
+}
+
+func TestValidate_BadTag(t *testing.T) {
+	type bad struct {
+		Name string `validate:"between=1"`
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for an unknown rule")
+		}
+	}()
+
+	_ = Validate(bad{})
+}
@@ -0,0 +1,3 @@
+drop trigger if exists audit_logs_append_only on audit_logs;
+drop function if exists audit_logs_append_only();
+drop table if exists audit_logs;
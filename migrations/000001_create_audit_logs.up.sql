@@ -0,0 +1,26 @@
+create table if not exists audit_logs (
+    id bigserial primary key,
+    actor_id integer not null,
+    actor_email varchar(255) not null default '',
+    action varchar(64) not null,
+    target_type varchar(64) not null,
+    target_id integer not null,
+    changes jsonb not null default '{}',
+    ip_address varchar(64) not null default '',
+    created_at timestamp not null default now()
+);
+
+create index if not exists audit_logs_target_idx on audit_logs (target_type, target_id);
+create index if not exists audit_logs_actor_idx on audit_logs (actor_id);
+create index if not exists audit_logs_created_at_idx on audit_logs (created_at);
+
+-- the audit log is append only: nobody gets to rewrite history
+create or replace function audit_logs_append_only() returns trigger as $$
+begin
+    raise exception 'audit_logs is append only';
+end;
+$$ language plpgsql;
+
+create trigger audit_logs_append_only
+    before update or delete on audit_logs
+    for each row execute function audit_logs_append_only();
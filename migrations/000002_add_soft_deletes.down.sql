@@ -0,0 +1,5 @@
+drop index if exists users_deleted_at_idx;
+drop index if exists books_deleted_at_idx;
+
+alter table users drop column if exists deleted_at;
+alter table books drop column if exists deleted_at;
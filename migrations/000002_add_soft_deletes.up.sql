@@ -0,0 +1,5 @@
+alter table books add column if not exists deleted_at timestamp;
+alter table users add column if not exists deleted_at timestamp;
+
+create index if not exists books_deleted_at_idx on books (deleted_at) where deleted_at is not null;
+create index if not exists users_deleted_at_idx on users (deleted_at) where deleted_at is not null;
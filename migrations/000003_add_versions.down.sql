@@ -0,0 +1,2 @@
+alter table users drop column if exists version;
+alter table books drop column if exists version;
@@ -0,0 +1,3 @@
+-- version is bumped on every update, and is what clients send back in If-Match
+alter table books add column if not exists version integer not null default 1;
+alter table users add column if not exists version integer not null default 1;
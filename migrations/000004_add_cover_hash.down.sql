@@ -0,0 +1,2 @@
+drop index if exists books_cover_hash_idx;
+alter table books drop column if exists cover_hash;
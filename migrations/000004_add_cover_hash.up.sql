@@ -0,0 +1,3 @@
+-- covers are stored under the hash of their content, so renaming a book never orphans its cover
+alter table books add column if not exists cover_hash varchar(64);
+create index if not exists books_cover_hash_idx on books (cover_hash);
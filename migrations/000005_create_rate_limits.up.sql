@@ -0,0 +1,8 @@
+-- token buckets for rate limiting, when they are shared between instances
+create table if not exists rate_limits (
+    key varchar(255) primary key,
+    tokens double precision not null,
+    updated_at timestamp with time zone not null,
+    expires_at timestamp with time zone not null
+);
+create index if not exists rate_limits_expires_at_idx on rate_limits (expires_at);
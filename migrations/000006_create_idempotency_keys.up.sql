@@ -0,0 +1,14 @@
+-- responses to requests sent with an Idempotency-Key, so retries get the same answer
+create table if not exists idempotency_keys (
+    id bigserial primary key,
+    user_id integer not null,
+    key varchar(255) not null,
+    request_hash varchar(64) not null,
+    status integer, -- null while the request is still being handled
+    headers jsonb,
+    body bytea,
+    created_at timestamp with time zone not null default now(),
+    expires_at timestamp with time zone not null,
+    unique (user_id, key)
+);
+create index if not exists idempotency_keys_expires_at_idx on idempotency_keys (expires_at);
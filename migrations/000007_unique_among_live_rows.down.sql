@@ -0,0 +1,7 @@
+-- fails if a deleted row shares its email or slug with another row, which has to be
+-- purged first
+drop index if exists users_email_live_key;
+drop index if exists books_slug_live_key;
+
+alter table users add constraint users_email_key unique (email);
+alter table books add constraint books_slug_key unique (slug);
@@ -0,0 +1,32 @@
+-- deleted users and books keep their email and slug, so these only have to be unique among
+-- the rows that aren't deleted. The original schema's unique constraints (or indexes) on them
+-- are replaced with partial unique indexes.
+do $$
+declare
+    c record;
+begin
+    for c in
+        select con.conrelid::regclass as tbl, con.conname as name
+        from pg_constraint con
+        join pg_attribute att on att.attrelid = con.conrelid and att.attnum = con.conkey[1]
+        where con.contype = 'u' and cardinality(con.conkey) = 1
+          and ((con.conrelid = 'users'::regclass and att.attname = 'email')
+            or (con.conrelid = 'books'::regclass and att.attname = 'slug'))
+    loop
+        execute format('alter table %s drop constraint %I', c.tbl, c.name);
+    end loop;
+
+    for c in
+        select idx.indexrelid::regclass as name
+        from pg_index idx
+        join pg_attribute att on att.attrelid = idx.indrelid and att.attnum = idx.indkey[0]
+        where idx.indisunique and not idx.indisprimary and idx.indnatts = 1 and idx.indpred is null
+          and ((idx.indrelid = 'users'::regclass and att.attname = 'email')
+            or (idx.indrelid = 'books'::regclass and att.attname = 'slug'))
+    loop
+        execute format('drop index %s', c.name);
+    end loop;
+end $$;
+
+create unique index if not exists users_email_live_key on users (email) where deleted_at is null;
+create unique index if not exists books_slug_live_key on books (slug) where deleted_at is null;